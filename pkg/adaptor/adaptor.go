@@ -1,13 +1,20 @@
 package adaptor
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
+	"text/template"
+	"time"
 
+	"github.com/compose/transporter/pkg/extjson"
+	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
@@ -20,6 +27,7 @@ var (
 		"file":          NewFile,
 		"elasticsearch": NewElasticsearch,
 		"influx":        NewInfluxdb,
+		"rethinkdb":     NewRethinkdb,
 		"transformer":   NewTransformer,
 	}
 )
@@ -125,4 +133,247 @@ type dbConfig struct {
 	URI       string `json:"uri"`       // the database uri
 	Namespace string `json:"namespace"` // namespace
 	Debug     bool   `json:"debug"`     // debug mode
+	Commands  string `json:"commands"`  // what a sink does with commands from the source, "apply", "warn" or "ignore"
+}
+
+// sinks can be configured to apply the drop, create and rename commands they receive from the source,
+// or to just emit a warning, or to ignore them altogether.
+const (
+	commandsApply  = "apply"
+	commandsWarn   = "warn"
+	commandsIgnore = "ignore"
+)
+
+// commandsOption validates the commands option, and defaults it to warn
+func commandsOption(s string) (string, error) {
+	switch s {
+	case "":
+		return commandsWarn, nil
+	case commandsApply, commandsWarn, commandsIgnore:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown commands option %q, expected %q, %q or %q", s, commandsApply, commandsWarn, commandsIgnore)
+}
+
+// commandWarning is the warning emitted by a sink that has been told not to apply commands
+func commandWarning(path string, c message.CommandType, arg interface{}) Error {
+	if c == message.Rename {
+		return NewError(WARNING, path, fmt.Sprintf("source was renamed to %v, not applied", arg), nil)
+	}
+	return NewError(WARNING, path, fmt.Sprintf("source %s command not applied", c), nil)
+}
+
+// copyStartMeta marks the flush that a source sends before a full copy, so that a sink that reindexes knows to write the
+// copy into a new index.  a source that picks up from a checkpoint, rather than copying everything, doesn't send it
+const copyStartMeta = "copy_start"
+
+// startCopy tells the sinks that a full copy of the source follows
+func startCopy(p *pipe.Pipe) {
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Meta = bson.M{copyStartMeta: true}
+	p.Send(flush)
+}
+
+// isCopyStart reports whether the message is the flush sent by startCopy
+func isCopyStart(msg *message.Msg) bool {
+	return msg.IsCommand(message.Flush) && msg.Meta[copyStartMeta] == true
+}
+
+// waitForSinks sends a flush down the pipeline, and waits until every sink has processed it, and so everything before it.
+// waitForSinks returns false if the pipeline stopped first
+func waitForSinks(p *pipe.Pipe) bool {
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	p.Send(flush)
+
+	for {
+		select {
+		case <-flush.Receipt.Done():
+			return true
+		case <-time.After(100 * time.Millisecond):
+			if p.Stopped {
+				return false
+			}
+		}
+	}
+}
+
+// formatOption validates the format option of adaptors that can write change-event envelopes rather than bare
+// documents, it's either "document" (the default) or "envelope".  it reports whether to use envelopes
+func formatOption(s string) (bool, error) {
+	switch s {
+	case "", "document":
+		return false, nil
+	case "envelope":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown format %q, expected \"document\" or \"envelope\"", s)
+}
+
+// the headers that carry a message's details alongside the document, when it's published to a message broker
+const (
+	opHeader        = "op"
+	namespaceHeader = "namespace"
+	partialHeader   = "partial"
+)
+
+// brokerHeaders are the headers to publish a message with
+func brokerHeaders(msg *message.Msg) map[string]string {
+	headers := map[string]string{opHeader: msg.Op.String()}
+	if ns := msg.Namespace(); ns != "" {
+		headers[namespaceHeader] = ns
+	}
+	if msg.Partial {
+		headers[partialHeader] = "true"
+	}
+	return headers
+}
+
+// brokerValue encodes a message to publish to a message broker, as canonical extended json of either the document or
+// it's envelope
+func brokerValue(msg *message.Msg, envelope bool) ([]byte, error) {
+	doc := msg.Document()
+	if envelope {
+		doc = message.NewEnvelope(msg).Document()
+	}
+	return extjson.Marshal(doc, extjson.Canonical)
+}
+
+// brokerMessage decodes a message read from a message broker.  without an op header the message is an insert,
+// and a document without an id takes it's id from the message key.  envelopes carry their own op and namespace
+func brokerMessage(value []byte, key string, header func(string) string, envelope bool) (*message.Msg, error) {
+	doc, err := extjson.Unmarshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if envelope {
+		if doc["key"] == nil && key != "" {
+			doc["key"] = key
+		}
+		e, err := message.EnvelopeFromDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		msg := e.Msg()
+		msg.Meta = nil
+		if e.Namespace != "" {
+			msg.Meta = bson.M{"namespace": e.Namespace}
+		}
+		return msg, nil
+	}
+
+	op := message.Insert
+	if h := header(opHeader); h != "" {
+		if op = message.OpTypeFromString(h); op == message.Unknown {
+			return nil, fmt.Errorf("unknown op")
+		}
+	}
+
+	if _, ok := doc["_id"]; !ok && op != message.Command && key != "" {
+		if _, ok := doc["id"]; !ok {
+			doc["_id"] = key
+		}
+	}
+
+	msg := message.NewMsg(op, doc)
+	msg.Partial = header(partialHeader) == "true"
+	if ns := header(namespaceHeader); ns != "" {
+		msg.Meta = bson.M{"namespace": ns}
+	}
+	return msg, nil
+}
+
+// messageTemplateData is what the templates for the topics, subjects, keys and urls that sinks write messages to are
+// filled in with
+type messageTemplateData struct {
+	Op        string
+	Namespace string
+	ID        string
+	Doc       bson.M
+}
+
+// executeMessageTemplate fills in a template with a message's details.  namespace is used for messages from sources
+// that don't say which namespace they came from
+func executeMessageTemplate(t *template.Template, msg *message.Msg, namespace string) (string, error) {
+	data := messageTemplateData{Op: msg.Op.String(), Namespace: msg.Namespace(), ID: msg.IDString(), Doc: msg.Document()}
+	if data.Namespace == "" {
+		data.Namespace = namespace
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// decodeJSON decodes a json value that was stored in a database column
+func decodeJSON(ba []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(ba))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return jsonValue(v), nil
+}
+
+// jsonValue converts json that was decoded with UseNumber into the types that the rest of the transporter expects,
+// objects become bson.M and numbers become ints where they can
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		doc := make(bson.M, len(t))
+		for k, v := range t {
+			doc[k] = jsonValue(v)
+		}
+		return doc
+	case []interface{}:
+		for i := range t {
+			t[i] = jsonValue(t[i])
+		}
+		return t
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int(i)
+			}
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
+
+// sqlValue converts the bson types that sql drivers don't know about
+func sqlValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.ObjectId:
+		return t.Hex()
+	case bson.Symbol:
+		return string(t)
+	case bson.MongoTimestamp:
+		return int64(t)
+	case int:
+		return int64(t)
+	case int32:
+		return int64(t)
+	case float32:
+		return float64(t)
+	}
+	return v
+}
+
+// sqlColumnValue converts a document value for a column, hashes and arrays are stored as json
+func sqlColumnValue(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case bson.M, map[string]interface{}, bson.D, []interface{}:
+		ba, err := extjson.Marshal(v, extjson.Relaxed)
+		if err != nil {
+			return nil, err
+		}
+		return string(ba), nil
+	}
+	return sqlValue(v), nil
 }
@@ -0,0 +1,277 @@
+package adaptor
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bulkBuffer collects encoded operations for a sink that writes in batches, and hands them to a send func
+// once the batch is big enough, or has been waiting long enough.  up to concurrency batches can be in flight at once.
+// errors from the send func are passed to onError, a failed batch isn't retried
+type bulkBuffer struct {
+	send    func(*bytes.Buffer) error
+	onError func(error)
+
+	maxOps        int           // send once this many operations are buffered
+	maxBytes      int           // send once the buffer holds this many bytes
+	flushInterval time.Duration // send anything that's been buffered for this long
+
+	buf *bytes.Buffer
+	ops int
+
+	inFlight chan struct{} // limits the number of concurrent sends
+	wg       sync.WaitGroup
+	done     chan struct{}
+
+	sync.Mutex
+}
+
+// newBulkBuffer creates a bulkBuffer.  zero values for the limits are replaced with sensible defaults
+func newBulkBuffer(send func(*bytes.Buffer) error, onError func(error), maxOps, maxBytes int, flushInterval time.Duration, concurrency int) *bulkBuffer {
+	if maxOps <= 0 {
+		maxOps = 100
+	}
+	if maxBytes <= 0 {
+		maxBytes = 1 << 20
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &bulkBuffer{
+		send:          send,
+		onError:       onError,
+		maxOps:        maxOps,
+		maxBytes:      maxBytes,
+		flushInterval: flushInterval,
+		buf:           new(bytes.Buffer),
+		inFlight:      make(chan struct{}, concurrency),
+		done:          make(chan struct{}),
+	}
+}
+
+// Start flushing the buffer every flushInterval
+func (b *bulkBuffer) Start() {
+	go func() {
+		ticker := time.NewTicker(b.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.Lock()
+				b.sendLocked()
+				b.Unlock()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+}
+
+// Add appends an encoded operation to the buffer, sending the buffer if it's full
+func (b *bulkBuffer) Add(op []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.ops > 0 && b.buf.Len()+len(op) > b.maxBytes {
+		b.sendLocked()
+	}
+	b.buf.Write(op)
+	b.ops++
+	if b.ops >= b.maxOps || b.buf.Len() >= b.maxBytes {
+		b.sendLocked()
+	}
+}
+
+// Flush sends whatever is buffered, and waits until every batch has been sent
+func (b *bulkBuffer) Flush() {
+	b.Lock()
+	b.sendLocked()
+	b.Unlock()
+	b.wg.Wait()
+}
+
+// Stop flushes the buffer and stops the timer
+func (b *bulkBuffer) Stop() {
+	b.Flush()
+	close(b.done)
+}
+
+// sendLocked hands the buffer to the send func in the background, it's called with the lock held
+func (b *bulkBuffer) sendLocked() {
+	if b.ops == 0 {
+		return
+	}
+	buf := b.buf
+	b.buf = new(bytes.Buffer)
+	b.ops = 0
+
+	b.inFlight <- struct{}{}
+	b.wg.Add(1)
+	go func() {
+		defer func() {
+			<-b.inFlight
+			b.wg.Done()
+		}()
+		if err := b.send(buf); err != nil {
+			b.onError(err)
+		}
+	}()
+}
+
+// sqlBatch collects the operations for a sink that writes to a sql database, and writes them in batches, each in it's
+// own transaction, once the batch is full, or has been waiting for flushInterval.  statement builds the sql for an
+// operation, and commands are handed to runCommand once the batch before them has been written.
+// errors are passed to onError, with the document they belong to, or nil if the whole batch failed
+type sqlBatch struct {
+	statement  func(*message.Msg) (string, []interface{}, error)
+	runCommand func(*message.Msg) error
+	onError    func(err error, record bson.M)
+
+	maxOps        int           // write once this many operations are batched
+	flushInterval time.Duration // write anything that's been batched for this long
+
+	db   *sql.DB
+	msgs []*message.Msg
+	done chan struct{}
+
+	sync.Mutex
+}
+
+// newSQLBatch creates a sqlBatch.  zero values for the limits are replaced with sensible defaults
+func newSQLBatch(statement func(*message.Msg) (string, []interface{}, error), runCommand func(*message.Msg) error, onError func(error, bson.M), maxOps int, flushInterval time.Duration) *sqlBatch {
+	if maxOps <= 0 {
+		maxOps = 500
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	return &sqlBatch{
+		statement:     statement,
+		runCommand:    runCommand,
+		onError:       onError,
+		maxOps:        maxOps,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+}
+
+// Listen writes the messages from the pipe to db until the pipe stops, writing out batches that haven't filled up
+// every flushInterval, and whatever is left once the pipe has stopped
+func (b *sqlBatch) Listen(p *pipe.Pipe, db *sql.DB) error {
+	b.db = db
+
+	go func() {
+		ticker := time.NewTicker(b.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.Flush()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	defer b.Flush()
+
+	return p.Listen(b.applyOp)
+}
+
+// Stop the timer
+func (b *sqlBatch) Stop() {
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+}
+
+// applyOp adds the message to the batch, commands are applied once the batch before them has been written
+func (b *sqlBatch) applyOp(msg *message.Msg) (*message.Msg, error) {
+	if msg.Op == message.Command {
+		b.Flush()
+		if err := b.runCommand(msg); err != nil {
+			b.onError(err, msg.Document())
+		}
+		return msg, nil
+	}
+
+	b.Lock()
+	b.msgs = append(b.msgs, msg)
+	full := len(b.msgs) >= b.maxOps
+	b.Unlock()
+
+	if full {
+		b.Flush()
+	}
+	return msg, nil
+}
+
+// Flush writes the batch in a transaction.  each operation runs inside a savepoint, so that one bad document is
+// reported as an error without losing the rest of the batch.  if the transaction can't be rolled back to the savepoint,
+// it's aborted, and none of the batch is written
+func (b *sqlBatch) Flush() {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.msgs) == 0 {
+		return
+	}
+	msgs := b.msgs
+	b.msgs = nil
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		b.onError(fmt.Errorf("%d operations not written, %s", len(msgs), err.Error()), nil)
+		return
+	}
+
+	for _, msg := range msgs {
+		aborted, err := b.exec(tx, msg)
+		if aborted {
+			tx.Rollback()
+			b.onError(fmt.Errorf("%d operations not written, %s", len(msgs), err.Error()), nil)
+			return
+		}
+		if err != nil {
+			b.onError(err, msg.Document())
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		b.onError(fmt.Errorf("%d operations not written, %s", len(msgs), err.Error()), nil)
+	}
+}
+
+// exec runs the statement for one message in a savepoint, releasing the savepoint if it succeeds, so that they don't
+// pile up in the transaction, and rolling back to it if it fails.  aborted is true if the error leaves the transaction
+// unable to carry on
+func (b *sqlBatch) exec(tx *sql.Tx, msg *message.Msg) (aborted bool, err error) {
+	query, args, err := b.statement(msg)
+	if err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec("SAVEPOINT op"); err != nil {
+		return true, err
+	}
+	if _, err = tx.Exec(query, args...); err != nil {
+		if _, rerr := tx.Exec("ROLLBACK TO SAVEPOINT op"); rerr != nil {
+			return true, fmt.Errorf("can't roll back to savepoint after %s (%s)", err.Error(), rerr.Error())
+		}
+		return false, err
+	}
+	if _, err = tx.Exec("RELEASE SAVEPOINT op"); err != nil {
+		return true, err
+	}
+	return false, nil
+}
@@ -0,0 +1,142 @@
+package adaptor
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBulkBuffer(t *testing.T) {
+	var (
+		sent []string
+		mu   sync.Mutex
+	)
+	b := newBulkBuffer(func(buf *bytes.Buffer) error {
+		mu.Lock()
+		sent = append(sent, buf.String())
+		mu.Unlock()
+		return nil
+	}, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	}, 2, 5, time.Hour, 1)
+	b.Start()
+
+	b.Add([]byte("a"))
+	b.Add([]byte("b")) // full on ops
+	b.Add([]byte("cde"))
+	b.Add([]byte("fgh")) // would go over maxBytes, so cde is sent first
+	b.Stop()
+
+	expected := []string{"ab", "cde", "fgh"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("expected: %v, got: %v", expected, sent)
+	}
+}
+
+// fakeSQL is a database/sql driver that records the statements it's given.  statements containing "bad" fail, and
+// so does rolling back to a savepoint if failRollback is set
+type fakeSQL struct {
+	failRollback bool
+
+	statements []string
+}
+
+var fakeSQLs = map[string]*fakeSQL{}
+
+func init() {
+	sql.Register("fakesql", fakeSQLDriver{})
+}
+
+type fakeSQLDriver struct{}
+
+func (fakeSQLDriver) Open(name string) (driver.Conn, error) { return fakeSQLs[name], nil }
+
+func (f *fakeSQL) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (f *fakeSQL) Close() error                              { return nil }
+
+func (f *fakeSQL) Begin() (driver.Tx, error) {
+	f.statements = append(f.statements, "BEGIN")
+	return f, nil
+}
+
+func (f *fakeSQL) Commit() error {
+	f.statements = append(f.statements, "COMMIT")
+	return nil
+}
+
+func (f *fakeSQL) Rollback() error {
+	f.statements = append(f.statements, "ROLLBACK")
+	return nil
+}
+
+func (f *fakeSQL) Exec(query string, args []driver.Value) (driver.Result, error) {
+	f.statements = append(f.statements, query)
+	if strings.Contains(query, "bad") || (f.failRollback && strings.HasPrefix(query, "ROLLBACK TO")) {
+		return nil, errors.New("failed")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func TestSQLBatch(t *testing.T) {
+	data := []struct {
+		failRollback bool
+		statements   []string
+		errs         []string
+	}{
+		{
+			false,
+			[]string{"BEGIN", "SAVEPOINT op", "good 1", "RELEASE SAVEPOINT op", "SAVEPOINT op", "bad 2", "ROLLBACK TO SAVEPOINT op", "SAVEPOINT op", "good 3", "RELEASE SAVEPOINT op", "COMMIT"},
+			[]string{"failed map[_id:2]"},
+		},
+		{
+			true,
+			[]string{"BEGIN", "SAVEPOINT op", "good 1", "RELEASE SAVEPOINT op", "SAVEPOINT op", "bad 2", "ROLLBACK TO SAVEPOINT op", "ROLLBACK"},
+			[]string{"3 operations not written, can't roll back to savepoint after failed (failed) map[]"},
+		},
+	}
+
+	for i, v := range data {
+		name := fmt.Sprintf("batch%d", i)
+		f := &fakeSQL{failRollback: v.failRollback}
+		fakeSQLs[name] = f
+		db, err := sql.Open("fakesql", name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var errs []string
+		b := newSQLBatch(func(msg *message.Msg) (string, []interface{}, error) {
+			if msg.ID == 2 {
+				return "bad 2", nil, nil
+			}
+			return fmt.Sprintf("good %v", msg.ID), nil, nil
+		}, func(msg *message.Msg) error {
+			return nil
+		}, func(err error, record bson.M) {
+			errs = append(errs, fmt.Sprintf("%s %v", err, record))
+		}, 3, time.Hour)
+		b.db = db
+
+		for id := 1; id <= 3; id++ { // the batch is full after the third
+			b.applyOp(message.NewMsg(message.Insert, bson.M{"_id": id}))
+		}
+		db.Close()
+
+		if !reflect.DeepEqual(f.statements, v.statements) {
+			t.Errorf("%d: expected: %q, got: %q", i, v.statements, f.statements)
+		}
+		if !reflect.DeepEqual(errs, v.errs) {
+			t.Errorf("%d: expected errors: %q, got: %q", i, v.errs, errs)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is the minimum time between writes of a checkpoint file
+const checkpointInterval = 1 * time.Second
+
+// checkpoint persists the position of a source adaptor in a file on disk, so that the adaptor can
+// pick up where it left off when the transporter is restarted.
+// positions are stored in a json object keyed by name, and a source can keep more than one position,
+// (ie. one for each shard it's reading from).
+// a nil checkpoint is valid, and doesn't remember anything
+type checkpoint struct {
+	filename  string
+	positions map[string]json.RawMessage
+	lastSave  time.Time
+
+	sync.Mutex
+}
+
+// newCheckpoint creates a checkpoint backed by the given file, loading any positions that were previously saved.
+// an empty filename returns a nil checkpoint
+func newCheckpoint(filename string) (*checkpoint, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	c := &checkpoint{
+		filename:  filename,
+		positions: make(map[string]json.RawMessage),
+	}
+
+	ba, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(ba) > 0 {
+		if err = json.Unmarshal(ba, &c.positions); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get unmarshals the position saved under name into v.  Get returns false if no position has been saved
+func (c *checkpoint) Get(name string, v interface{}) (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	raw, ok := c.positions[name]
+	if !ok {
+		return false, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // don't lose precision on large integers
+	return true, dec.Decode(v)
+}
+
+// Set records the position under name.  positions aren't written to disk until Save is called
+func (c *checkpoint) Set(name string, v interface{}) error {
+	if c == nil {
+		return nil
+	}
+	ba, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.positions[name] = ba
+	c.Unlock()
+	return nil
+}
+
+// Save writes the positions to disk.  unless force is set, the write is skipped if the file has
+// been written recently.  the file is replaced atomically, so a crash won't leave a partial checkpoint behind
+func (c *checkpoint) Save(force bool) error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if !force && time.Since(c.lastSave) < checkpointInterval {
+		return nil
+	}
+
+	ba, err := json.Marshal(c.positions)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, ba, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.filename); err != nil {
+		return err
+	}
+	c.lastSave = time.Now()
+	return nil
+}
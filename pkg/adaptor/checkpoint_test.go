@@ -0,0 +1,47 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "checkpoint.json")
+
+	c, err := newCheckpoint(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var position int64
+	if ok, _ := c.Get("shard0", &position); ok {
+		t.Errorf("expected no position in a new checkpoint")
+	}
+
+	c.Set("shard0", int64(6442450945))
+	c.Set("shard1", int64(12))
+	if err = c.Save(true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	c, err = newCheckpoint(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok, err := c.Get("shard0", &position); !ok || err != nil || position != 6442450945 {
+		t.Errorf("expected 6442450945, got %d (%t, %v)", position, ok, err)
+	}
+
+	// a nil checkpoint doesn't remember anything
+	c, _ = newCheckpoint("")
+	c.Set("shard0", 1)
+	if ok, _ := c.Get("shard0", &position); ok {
+		t.Errorf("expected a nil checkpoint to be empty")
+	}
+}
@@ -1,20 +1,27 @@
 package adaptor
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/extjson"
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
-	elastigo "github.com/mattbaird/elastigo/lib"
+	"gopkg.in/mgo.v2/bson"
 )
 
 // Elasticsearch is an adaptor to connect a pipeline to
 // an elasticsearch cluster.
 type Elasticsearch struct {
 	// pull these in from the node
-	uri *url.URL
+	hosts []*url.URL
+	sniff bool
 
 	_type string
 	index string
@@ -22,61 +29,175 @@ type Elasticsearch struct {
 	pipe *pipe.Pipe
 	path string
 
-	indexer *elastigo.BulkIndexer
+	commands string // what to do with commands from the source
+
+	// sink options
+	target     string      // the index that documents are written to, when reindexing this is a versioned index
+	reindex    bool        // write copies into a new index, and point an alias at it once the copy is complete
+	reindexing bool        // a copy is being written into a new index
+	mapping    interface{} // the settings and mappings for new indexes
+
+	// where the routing, parent, version and ingest pipeline of each document come from, see documentField
+	routing     string
+	parent      string
+	version     string
+	versionType string
+	pipeline    string
+
+	// source options
+	query      interface{}
+	sort       string
+	scroll     bool
+	batchSize  int
+	checkpoint *checkpoint
+	copied     int // the number of documents read by the source
+
+	client  *esCluster
+	bulk    *bulkBuffer
 	running bool
 }
 
 // NewElasticsearch creates a new Elasticsearch adaptor.
-// Elasticsearch adaptors cannot be used as a source,
 func NewElasticsearch(p *pipe.Pipe, path string, extra Config) (StopStartListener, error) {
 	var (
-		conf dbConfig
+		conf ElasticsearchConfig
 		err  error
 	)
 	if err = extra.Construct(&conf); err != nil {
 		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't create constructor (%s)", err.Error()), nil)
 	}
 
-	u, err := url.Parse(conf.URI)
+	hosts, err := parseESHosts(conf.URI)
 	if err != nil {
-		return nil, err
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Malformed uri (%s)", err.Error()), nil)
 	}
 
 	e := &Elasticsearch{
-		uri:  u,
-		pipe: p,
+		hosts:     hosts,
+		sniff:     conf.Sniff,
+		pipe:      p,
+		path:      path,
+		query:     conf.Query,
+		sort:      conf.Sort,
+		scroll:    conf.Scroll,
+		batchSize: conf.BatchSize,
+		reindex:   conf.Reindex,
+
+		routing:     conf.Routing,
+		parent:      conf.Parent,
+		version:     conf.Version,
+		versionType: conf.VersionType,
+		pipeline:    conf.Pipeline,
+	}
+
+	if e.sort == "" {
+		e.sort = "_id"
+	}
+	if e.batchSize <= 0 {
+		e.batchSize = 500
+	}
+	if e.version != "" && e.versionType == "" {
+		e.versionType = "external"
+	}
+	if s, ok := e.query.(string); ok && s != "" { // the query can be a string of json
+		if err = json.Unmarshal([]byte(s), &e.query); err != nil {
+			return e, NewError(CRITICAL, path, fmt.Sprintf("Malformed query (%s)", err.Error()), nil)
+		}
+	}
+
+	e.checkpoint, err = newCheckpoint(conf.Checkpoint)
+	if err != nil {
+		return e, NewError(CRITICAL, path, fmt.Sprintf("Can't load checkpoint (%s)", err.Error()), nil)
+	}
+
+	if conf.Mapping != "" {
+		ba, err := ioutil.ReadFile(conf.Mapping)
+		if err != nil {
+			return e, NewError(CRITICAL, path, fmt.Sprintf("Can't read mapping (%s)", err.Error()), nil)
+		}
+		if err = json.Unmarshal(ba, &e.mapping); err != nil {
+			return e, NewError(CRITICAL, path, fmt.Sprintf("Malformed mapping (%s)", err.Error()), nil)
+		}
+	}
+
+	var flushInterval time.Duration
+	if conf.FlushInterval != "" {
+		if flushInterval, err = time.ParseDuration(conf.FlushInterval); err != nil {
+			return e, NewError(CRITICAL, path, fmt.Sprintf("Malformed flush_interval (%s)", err.Error()), nil)
+		}
+	}
+	e.bulk = newBulkBuffer(e.sendBulk, func(err error) {
+		e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), nil)
+	}, conf.BulkSize, conf.BulkBytes, flushInterval, conf.BulkConcurrency)
+
+	e.commands, err = commandsOption(conf.Commands)
+	if err != nil {
+		return e, NewError(CRITICAL, path, err.Error(), nil)
 	}
 
 	e.index, e._type, err = extra.splitNamespace()
 	if err != nil {
 		return e, NewError(CRITICAL, path, fmt.Sprintf("Can't split namespace into _index._type (%s)", err.Error()), nil)
 	}
+	e.target = e.index
 
 	return e, nil
 }
 
-// Start the adaptor as a source (not implemented)
-func (e *Elasticsearch) Start() error {
-	return fmt.Errorf("Elasticsearch can't function as a source")
+// Start the adaptor as a source.  the documents in the index / type that match the query are read in pages with
+// search_after, sorted by the sort field.  the sort key of the last page is saved in the checkpoint, and the next
+// run will start after it, so if the sort field is something like an updated_at timestamp, each run only picks up what's changed.
+// if scroll is set, the scroll api is used instead, which can't be resumed.
+func (e *Elasticsearch) Start() (err error) {
+	defer func() {
+		e.pipe.Stop()
+	}()
+
+	e.setupClient()
+
+	if e.scroll {
+		err = e.scrollIndex()
+	} else {
+		err = e.searchAfter()
+	}
+	if err != nil {
+		e.pipe.Err <- err
+		return err
+	}
+
+	if !e.pipe.Stopped {
+		e.pipe.Send(message.NewCommandMsg(message.CopyComplete, nil))
+		e.pipe.Event <- events.NewSnapshotEvent(time.Now().Unix(), e.path, e.copied, "")
+	}
+	return nil
 }
 
-// Listen starts the listener
+// Listen starts the listener.  when reindexing, documents are written to the index that the namespace's index is an
+// alias of, until the source starts a full copy, which is written into a new index.  the alias is pointed at the new
+// index once the source has finished it's copy.  a source that picks up from a checkpoint doesn't copy, so it's changes
+// go on being written to the index the alias points at
 func (e *Elasticsearch) Listen() error {
 	e.setupClient()
-	e.indexer.Start()
-	e.running = true
-
-	go func(cherr chan *elastigo.ErrorBuffer) {
-		for err := range e.indexer.ErrorChannel {
-			e.pipe.Err <- NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Err), nil)
+	if e.reindex {
+		current, err := e.aliasIndex()
+		if err == nil && current != "" {
+			e.target = current
+		} else if err == nil {
+			err = e.startReindex() // there's nothing to add to yet
 		}
-	}(e.indexer.ErrorChannel)
+		if err != nil {
+			e.pipe.Err <- NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), nil)
+			return err
+		}
+	}
+	e.bulk.Start()
+	e.running = true
 
 	defer func() {
 		if e.running {
 			e.running = false
 			e.pipe.Stop()
-			e.indexer.Stop()
+			e.bulk.Stop()
 		}
 	}()
 
@@ -88,53 +209,530 @@ func (e *Elasticsearch) Stop() error {
 	if e.running {
 		e.running = false
 		e.pipe.Stop()
-		e.indexer.Stop()
+		e.bulk.Stop()
 	}
 	return nil
 }
 
+// applyOp adds the message to the bulk request.  inserts and updates index the whole document, so they create the document
+// if it's missing and replace it if it isn't.  partial updates are sent as an _update, with doc_as_upsert so that
+// a document that isn't in the index yet is still created
 func (e *Elasticsearch) applyOp(msg *message.Msg) (*message.Msg, error) {
 	if msg.Op == message.Command {
-		err := e.runCommand(msg)
-		e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s)", err), msg.Document())
+		if err := e.runCommand(msg); err != nil {
+			e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), msg.Document())
+		}
 		return msg, nil
 	}
 
-	err := e.indexer.Index(e.index, e._type, msg.IDString(), "", nil, msg.Document(), false)
-	e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s)", err), msg.Document())
+	op, err := e.bulkOp(msg)
+	if err != nil {
+		e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), msg.Document())
+		return msg, nil
+	}
+	e.bulk.Add(op)
 	return msg, nil
 }
 
-func (e *Elasticsearch) setupClient() {
-	// set up the client, we need host(s), port, username, password, and scheme
-	client := elastigo.NewConn()
+// bulkOp encodes the message as an action line for a bulk request, followed by the document if the action needs one
+func (e *Elasticsearch) bulkOp(msg *message.Msg) ([]byte, error) {
+	action := "index"
+	meta := map[string]interface{}{"_index": e.target, "_type": e._type, "_id": msg.IDString()}
+	var doc interface{} = msg.Document()
+
+	switch {
+	case msg.Op == message.Delete:
+		action, doc = "delete", nil
+	case msg.Op == message.Update && msg.Partial:
+		action, doc = "update", map[string]interface{}{"doc": msg.Document(), "doc_as_upsert": true}
+	}
 
-	if e.uri.User != nil {
-		client.Username = e.uri.User.Username()
-		if password, set := e.uri.User.Password(); set {
-			client.Password = password
+	if v := e.documentField(msg, e.routing); v != nil {
+		meta["_routing"] = v
+	}
+	if v := e.documentField(msg, e.parent); v != nil {
+		meta["_parent"] = v
+	}
+	if v := e.documentField(msg, e.version); v != nil && action != "update" { // updates can't be externally versioned
+		meta["_version"] = v
+		meta["_version_type"] = e.versionType
+	}
+	if v := e.documentField(msg, e.pipeline); v != nil && action == "index" {
+		meta["pipeline"] = v
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(map[string]interface{}{action: meta}); err != nil {
+		return nil, err
+	}
+	if doc != nil {
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
 		}
 	}
+	return buf.Bytes(), nil
+}
 
-	// we might have a port in the host bit
-	hostBits := strings.Split(e.uri.Host, ":")
-	if len(hostBits) > 1 {
-		client.SetPort(hostBits[1])
+// documentField looks up one of the routing, parent, version or pipeline options.  the option names a field of the
+// document, or with a leading @, a key in the metadata set by the source, ie. "@ts" is the position in a mongo oplog
+func (e *Elasticsearch) documentField(msg *message.Msg, name string) interface{} {
+	switch {
+	case name == "":
+		return nil
+	case strings.HasPrefix(name, "@"):
+		return msg.Meta[name[1:]]
 	}
+	return msg.Document()[name]
+}
 
-	client.SetHosts(strings.Split(hostBits[0], ","))
-	client.Protocol = e.uri.Scheme
+// sendBulk posts a bulk request, and reports an error for each document that elasticsearch failed to write.
+// an error is only returned when the request itself fails
+func (e *Elasticsearch) sendBulk(buf *bytes.Buffer) error {
+	actions := parseBulkActions(buf.Bytes())
 
-	e.indexer = client.NewBulkIndexerErrors(10, 60)
+	ba, err := e.client.DoCommand("POST", "/_bulk", nil, buf.Bytes())
+	for wait := time.Second; err != nil && isConnectionError(err) && wait <= esBulkMaxWait; wait *= 2 {
+		// none of the nodes could be reached, hang on to the documents and wait for the cluster to come back
+		e.pipe.Err <- NewError(WARNING, e.path, fmt.Sprintf("Elasticsearch error (%s, retrying in %s)", err.Error(), wait), nil)
+		time.Sleep(wait)
+		ba, err = e.client.DoCommand("POST", "/_bulk", nil, buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("bulk request of %d documents failed (%s)", len(actions), err.Error())
+	}
+
+	var resp esBulkResponse
+	if err = json.Unmarshal(ba, &resp); err != nil {
+		return fmt.Errorf("can't decode bulk response (%s)", err.Error())
+	}
+	if !resp.Errors {
+		return nil
+	}
+
+	for i, item := range resp.Items {
+		for op, result := range item {
+			if !result.failed(op, e.version != "") {
+				continue
+			}
+			record := bson.M{"_id": result.ID}
+			if i < len(actions) && actions[i].doc != nil {
+				record = actions[i].doc
+			}
+			e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (%s %s failed, %s)", op, result.ID, result.Error), record)
+		}
+	}
+	return nil
+}
+
+// setupClient connects to the cluster.  nodes that can't be reached are reported as warnings, requests
+// only fail once none of the nodes can be reached
+func (e *Elasticsearch) setupClient() {
+	e.client = newESCluster(e.hosts, e.sniff, func(node string, err error) {
+		e.pipe.Err <- NewError(WARNING, e.path, fmt.Sprintf("Elasticsearch error (can't reach %s, %s)", node, err.Error()), nil)
+	})
 }
 
+// runCommand flushes the indexer, and applies drop and create commands to the index.
+// elasticsearch can't rename an index, so renames are only ever a warning
 func (e *Elasticsearch) runCommand(msg *message.Msg) error {
-	if _, hasKey := msg.Document()["flush"]; hasKey {
-		e.indexer.Flush()
+	c, arg, ok := msg.Command()
+	if !ok {
+		return nil
+	}
+	if c == message.Flush {
+		e.bulk.Flush()
+		if e.reindex && !e.reindexing && isCopyStart(msg) {
+			return e.startReindex()
+		}
+		return nil
+	}
+	if c == message.CopyComplete {
+		e.bulk.Flush()
+		if e.reindexing {
+			e.reindexing = false
+			return e.swapAlias()
+		}
+		return nil
+	}
+
+	if e.commands == commandsIgnore {
+		return nil
+	}
+	if e.commands == commandsWarn || c == message.Rename {
+		e.pipe.Err <- commandWarning(e.path, c, arg)
+		return nil
+	}
+
+	switch c {
+	case message.Drop:
+		e.bulk.Flush()
+		_, err := e.client.DoCommand("DELETE", "/"+e.target, nil, nil)
+		return err
+	case message.Create:
+		return e.createIndex(e.target)
 	}
 	return nil
 }
 
+// createIndex creates an index with the configured settings and mappings
+func (e *Elasticsearch) createIndex(name string) error {
+	_, err := e.client.DoCommand("PUT", "/"+name, nil, e.mapping)
+	return err
+}
+
+// startReindex creates a new index, named after the namespace's index and the time, and writes to it from now on
+func (e *Elasticsearch) startReindex() error {
+	target := fmt.Sprintf("%s_%s", e.index, time.Now().UTC().Format("20060102150405"))
+	if err := e.createIndex(target); err != nil {
+		return fmt.Errorf("can't create index %s, %s", target, err.Error())
+	}
+	e.target, e.reindexing = target, true
+	return nil
+}
+
+// aliasIndex returns the index that the namespace's index is an alias of, or "" if it isn't an alias yet.
+// if the alias somehow points at more than one index, the newest is used
+func (e *Elasticsearch) aliasIndex() (string, error) {
+	current, err := e.aliases()
+	if err != nil {
+		return "", err
+	}
+	newest := ""
+	for index := range current {
+		if index > newest {
+			newest = index
+		}
+	}
+	return newest, nil
+}
+
+// aliases returns the indexes that the namespace's index is an alias of
+func (e *Elasticsearch) aliases() (map[string]interface{}, error) {
+	// elasticsearch answers with a 404 if nothing has the alias yet
+	ba, err := e.client.DoCommand("GET", "/_alias/"+e.index, nil, nil)
+	if err != nil {
+		return nil, nil
+	}
+	var current map[string]interface{}
+	if err = json.Unmarshal(ba, &current); err != nil {
+		return nil, fmt.Errorf("can't decode aliases (%s)", err.Error())
+	}
+	return current, nil
+}
+
+// swapAlias points the alias at the index we've been writing to, and removes it from any other index in the same request,
+// so that searches against the alias go from the old index to the new one in one step.
+// the old indexes are left alone, so that the alias can be pointed back at them if something is wrong with the new one
+func (e *Elasticsearch) swapAlias() error {
+	actions := []interface{}{
+		map[string]interface{}{"add": map[string]string{"index": e.target, "alias": e.index}},
+	}
+
+	current, err := e.aliases()
+	if err != nil {
+		return err
+	}
+	for index := range current {
+		if index != e.target {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": e.index}})
+		}
+	}
+
+	_, err = e.client.DoCommand("POST", "/_aliases", nil, map[string]interface{}{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("can't point alias %s at %s (%s)", e.index, e.target, err.Error())
+	}
+	return nil
+}
+
+// searchAfter pages through the index in sort order, starting after the sort key saved in the checkpoint.
+// documents are sorted by their id after the sort field, so that documents sharing a sort value can't be skipped at the
+// end of a page.  the sort key of a page is only checkpointed once the sinks have processed it
+func (e *Elasticsearch) searchAfter() error {
+	var after []interface{}
+	if _, err := e.checkpoint.Get("search_after", &after); err != nil {
+		return NewError(CRITICAL, e.path, fmt.Sprintf("Can't read checkpoint (%s)", err.Error()), nil)
+	}
+
+	idField, err := e.idField()
+	if err != nil {
+		return NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), nil)
+	}
+	if after == nil { // otherwise we're only reading what's changed since the checkpoint
+		startCopy(e.pipe)
+	}
+
+	for {
+		resp, err := e.search(fmt.Sprintf("/%s/%s/_search", e.index, e._type), nil, e.searchAfterBody(idField, after))
+		if err != nil {
+			return err
+		}
+		if len(resp.Hits.Hits) == 0 {
+			return e.checkpoint.Save(true)
+		}
+
+		if !e.sendHits(resp.Hits.Hits) {
+			return nil
+		}
+
+		after = resp.Hits.Hits[len(resp.Hits.Hits)-1].Sort
+		if e.checkpoint == nil {
+			continue
+		}
+		if !waitForSinks(e.pipe) {
+			return nil
+		}
+		e.checkpoint.Set("search_after", after)
+		if err = e.checkpoint.Save(false); err != nil {
+			e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Can't save checkpoint (%s)", err.Error()), nil)
+		}
+	}
+}
+
+// searchAfterBody is the search for the page after the given sort key, sorted by the sort field and then by idField
+func (e *Elasticsearch) searchAfterBody(idField string, after []interface{}) map[string]interface{} {
+	sort := []interface{}{map[string]interface{}{idField: "asc"}}
+	if e.sort != "_id" && e.sort != "_uid" {
+		sort = append([]interface{}{map[string]interface{}{e.sort: "asc"}}, sort...)
+	}
+
+	body := map[string]interface{}{
+		"size": e.batchSize,
+		"sort": sort,
+	}
+	if e.query != nil {
+		body["query"] = e.query
+	}
+	if after != nil {
+		body["search_after"] = after
+	}
+	return body
+}
+
+// idField is the field that documents are sorted by to break ties, elasticsearch before 6.0 can only sort by _uid
+func (e *Elasticsearch) idField() (string, error) {
+	ba, err := e.client.DoCommand("GET", "/", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+	if err = json.Unmarshal(ba, &info); err != nil {
+		return "", fmt.Errorf("can't decode cluster info %s", err.Error())
+	}
+
+	var major int
+	if _, err = fmt.Sscanf(info.Version.Number, "%d.", &major); err != nil {
+		return "", fmt.Errorf("unknown version %q", info.Version.Number)
+	}
+	if major < 6 {
+		return "_uid", nil
+	}
+	return "_id", nil
+}
+
+// scrollIndex reads the whole index with the scroll api
+func (e *Elasticsearch) scrollIndex() error {
+	body := map[string]interface{}{
+		"size": e.batchSize,
+		"sort": []string{"_doc"},
+	}
+	if e.query != nil {
+		body["query"] = e.query
+	}
+
+	startCopy(e.pipe)
+	resp, err := e.search(fmt.Sprintf("/%s/%s/_search", e.index, e._type), map[string]interface{}{"scroll": esScrollTimeout}, body)
+	for {
+		if err != nil {
+			return err
+		}
+		if len(resp.Hits.Hits) == 0 || !e.sendHits(resp.Hits.Hits) {
+			break
+		}
+		resp, err = e.search("/_search/scroll", nil, map[string]interface{}{"scroll": esScrollTimeout, "scroll_id": resp.ScrollID})
+	}
+
+	// clean up after ourselves, the scroll would expire anyway
+	e.client.DoCommand("DELETE", "/_search/scroll", nil, map[string]interface{}{"scroll_id": []string{resp.ScrollID}})
+	return nil
+}
+
+// search runs a search request and decodes the response
+func (e *Elasticsearch) search(url string, args map[string]interface{}, body interface{}) (*esSearchResponse, error) {
+	ba, err := e.client.DoCommand("POST", url, args, body)
+	if err != nil {
+		return nil, NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (%s)", err.Error()), nil)
+	}
+
+	var resp esSearchResponse
+	dec := json.NewDecoder(bytes.NewReader(ba))
+	dec.UseNumber() // keep large sort keys intact
+	if err = dec.Decode(&resp); err != nil {
+		return nil, NewError(CRITICAL, e.path, fmt.Sprintf("Elasticsearch error (can't decode response %s)", err.Error()), nil)
+	}
+	return &resp, nil
+}
+
+// sendHits sends each document down the pipe, keyed by it's _id.  sendHits returns false if the pipe has been stopped
+func (e *Elasticsearch) sendHits(hits []esHit) bool {
+	for _, hit := range hits {
+		if e.pipe.Stopped {
+			return false
+		}
+
+		doc, err := extjson.Unmarshal(hit.Source)
+		if err != nil {
+			e.pipe.Err <- NewError(ERROR, e.path, fmt.Sprintf("Elasticsearch error (can't decode document %s %s)", hit.ID, err.Error()), nil)
+			continue
+		}
+		doc["_id"] = hit.ID
+		e.pipe.Send(message.NewMsg(message.Insert, doc))
+		e.copied++
+	}
+	return true
+}
+
+// esBulkMaxWait is the longest wait between retries of a bulk request when the cluster can't be reached
+const esBulkMaxWait = 32 * time.Second
+
+// esScrollTimeout is how long elasticsearch keeps a scroll alive between requests
+const esScrollTimeout = "5m"
+
+// esSearchResponse is the part of a search response that we're interested in
+type esSearchResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []esHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type esHit struct {
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+	Sort   []interface{}   `json:"sort"`
+}
+
+// esBulkResponse is the response to a bulk request, each item is keyed by the action, ie. {"index": {...}}
+type esBulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]esBulkItemResult `json:"items"`
+}
+
+type esBulkItemResult struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// failed reports whether the action failed.  deleting a document that isn't there isn't a failure, and when
+// documents are versioned, neither is a conflict, it means the index already has a newer version of the document
+func (r esBulkItemResult) failed(op string, versioned bool) bool {
+	if op == "delete" && r.Status == 404 {
+		return false
+	}
+	if versioned && r.Status == 409 {
+		return false
+	}
+	return r.Status >= 300
+}
+
+// bulkAction is one action from the body of a bulk request, along with the document that was sent with it
+type bulkAction struct {
+	op  string
+	doc bson.M
+}
+
+// parseBulkActions splits the body of a bulk request back into its actions, so that a failure in the
+// response can be matched up with the document that failed.  every action is followed by a document,
+// except for deletes
+func parseBulkActions(body []byte) []bulkAction {
+	var actions []bulkAction
+	lines := bytes.Split(body, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		var meta map[string]json.RawMessage
+		if err := json.Unmarshal(line, &meta); err != nil {
+			continue
+		}
+		for op := range meta {
+			action := bulkAction{op: op}
+			if op != "delete" && i+1 < len(lines) {
+				i++
+				action.doc, _ = extjson.Unmarshal(lines[i])
+			}
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// ElasticsearchConfig provides configuration options for an elasticsearch adaptor
+type ElasticsearchConfig struct {
+	URI       string `json:"uri"`       // the elasticsearch uri, or a comma separated list of uris for each of the seed hosts
+	Sniff     bool   `json:"sniff"`     // discover the rest of the cluster's nodes from the seed hosts
+	Namespace string `json:"namespace"` // the index and type, as index.type
+	Debug     bool   `json:"debug"`     // debug mode
+	Commands  string `json:"commands"`  // what a sink does with commands from the source, "apply", "warn" or "ignore"
+
+	// Query limits the documents read by a source, it can be either a hash or a string of json, eg. {"term": {"active": true}}
+	Query interface{} `json:"query"`
+
+	// Sort is the field that the source pages through the index by, it defaults to _id.  documents with the same
+	// value are sorted by their _id
+	Sort string `json:"sort"`
+
+	// Scroll reads the index with the scroll api instead of search_after, scrolls can't be resumed
+	Scroll bool `json:"scroll"`
+
+	// BatchSize is the number of documents the source requests at once, it defaults to 500
+	BatchSize int `json:"batch_size"`
+
+	// Reindex has the sink write a full copy from the source into a new index named after the namespace's index and the
+	// time, ie. posts_20150102150405.  once the source signals that it's copy is complete, the namespace's index is made
+	// an alias of the new index.  the previous index isn't deleted.  a source that picks up from a checkpoint doesn't copy,
+	// and it's changes are written to the index the alias points at
+	Reindex bool `json:"reindex"`
+
+	// Mapping is a json file with the settings and mappings used when the sink creates an index
+	Mapping string `json:"mapping"`
+
+	// BulkSize is the number of documents the sink sends in each bulk request, it defaults to 100
+	BulkSize int `json:"bulk_size"`
+
+	// BulkBytes is the largest bulk request the sink sends, in bytes, it defaults to 1MB
+	BulkBytes int `json:"bulk_bytes"`
+
+	// FlushInterval is how long documents wait for a bulk request to fill up before it's sent anyway, ie. "500ms", it defaults to 1s
+	FlushInterval string `json:"flush_interval"`
+
+	// BulkConcurrency is the number of bulk requests the sink can have in flight at once, it defaults to 1.
+	// with more than one, operations on the same document can be applied out of order, unless they're versioned
+	BulkConcurrency int `json:"bulk_concurrency"`
+
+	// Routing, Parent, Version and Pipeline name the document field that each document's routing, parent, version and
+	// ingest pipeline are taken from.  a name starting with @ is taken from the metadata set by the source instead,
+	// ie. "@ts" is the position of the operation in a mongo oplog
+	Routing  string `json:"routing"`
+	Parent   string `json:"parent"`
+	Version  string `json:"version"`
+	Pipeline string `json:"pipeline"`
+
+	// VersionType is the elasticsearch version_type used with Version, it defaults to external, so that an older version of
+	// a document can't overwrite a newer one
+	VersionType string `json:"version_type"`
+
+	// Checkpoint is a file where the source saves the sort key of the last document it sent
+	Checkpoint string `json:"checkpoint"`
+}
+
 func (e *Elasticsearch) getNamespace() string {
 	return strings.Join([]string{e.index, e._type}, ".")
 }
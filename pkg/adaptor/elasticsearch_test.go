@@ -0,0 +1,436 @@
+package adaptor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseBulkActions(t *testing.T) {
+	body := `{"index":{"_index":"test","_type":"t","_id":"1"}}
+{"name":"one"}
+{"delete":{"_index":"test","_type":"t","_id":"2"}}
+{"update":{"_index":"test","_type":"t","_id":"3"}}
+{"doc":{"name":"three"},"doc_as_upsert":true}
+`
+	expected := []bulkAction{
+		{"index", bson.M{"name": "one"}},
+		{"delete", nil},
+		{"update", bson.M{"doc": bson.M{"name": "three"}, "doc_as_upsert": true}},
+	}
+
+	actions := parseBulkActions([]byte(body))
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("expected: %v, got: %v", expected, actions)
+	}
+}
+
+func TestBulkItemFailed(t *testing.T) {
+	data := []struct {
+		op        string
+		status    int
+		versioned bool
+		out       bool
+	}{
+		{"index", 201, false, false},
+		{"index", 400, false, true},
+		{"index", 409, false, true},
+		{"index", 409, true, false}, // the index already had a newer version
+		{"update", 200, false, false},
+		{"update", 409, false, true},
+		{"delete", 200, false, false},
+		{"delete", 404, false, false},
+		{"delete", 500, false, true},
+	}
+
+	for _, v := range data {
+		if out := (esBulkItemResult{Status: v.status}).failed(v.op, v.versioned); out != v.out {
+			t.Errorf("%s %d %t: expected: %t, got: %t", v.op, v.status, v.versioned, v.out, out)
+		}
+	}
+}
+
+func TestBulkOp(t *testing.T) {
+	e := &Elasticsearch{target: "test", _type: "t", routing: "user", version: "@ts", versionType: "external"}
+
+	deleted := message.NewMsg(message.Delete, bson.M{"_id": "2"})
+	deleted.Meta = bson.M{"ts": int64(10)}
+	updated := message.NewMsg(message.Update, bson.M{"_id": "3", "user": "sue"})
+	updated.Partial = true
+	updated.Meta = bson.M{"ts": int64(11)}
+
+	data := []struct {
+		msg *message.Msg
+		out string
+	}{
+		{
+			message.NewMsg(message.Insert, bson.M{"_id": "1", "user": "bob"}),
+			`{"index":{"_id":"1","_index":"test","_routing":"bob","_type":"t"}}` + "\n" + `{"_id":"1","user":"bob"}` + "\n",
+		},
+		{
+			deleted,
+			`{"delete":{"_id":"2","_index":"test","_type":"t","_version":10,"_version_type":"external"}}` + "\n",
+		},
+		{
+			updated,
+			`{"update":{"_id":"3","_index":"test","_routing":"sue","_type":"t"}}` + "\n" + `{"doc":{"_id":"3","user":"sue"},"doc_as_upsert":true}` + "\n",
+		},
+	}
+
+	for _, v := range data {
+		out, err := e.bulkOp(v.msg)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			continue
+		}
+		if string(out) != v.out {
+			t.Errorf("expected: %s, got: %s", v.out, out)
+		}
+	}
+}
+
+func TestSearchAfterBody(t *testing.T) {
+	data := []struct {
+		sort    string
+		idField string
+		after   []interface{}
+		out     string
+	}{
+		{"_id", "_id", nil, `{"size":2,"sort":[{"_id":"asc"}]}`},
+		{"_id", "_uid", []interface{}{"t#5"}, `{"search_after":["t#5"],"size":2,"sort":[{"_uid":"asc"}]}`},
+		{"updated_at", "_id", nil, `{"size":2,"sort":[{"updated_at":"asc"},{"_id":"asc"}]}`},
+		{"updated_at", "_uid", []interface{}{10, "t#5"}, `{"search_after":[10,"t#5"],"size":2,"sort":[{"updated_at":"asc"},{"_uid":"asc"}]}`},
+	}
+
+	for _, v := range data {
+		e := &Elasticsearch{sort: v.sort, batchSize: 2}
+		ba, _ := json.Marshal(e.searchAfterBody(v.idField, v.after))
+		if string(ba) != v.out {
+			t.Errorf("%s %s: expected: %s, got: %s", v.sort, v.idField, v.out, ba)
+		}
+	}
+}
+
+// fakeESSearch serves searches over the docs, sorted by updated_at and then _id, the way elasticsearch does
+func fakeESSearch(t *testing.T, docs []bson.M) *httptest.Server {
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i]["updated_at"] != docs[j]["updated_at"] {
+			return docs[i]["updated_at"].(int) < docs[j]["updated_at"].(int)
+		}
+		return docs[i]["_id"].(string) < docs[j]["_id"].(string)
+	})
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `{"version": {"number": "6.8.0"}}`)
+			return
+		}
+		var body struct {
+			Size        int           `json:"size"`
+			SearchAfter []interface{} `json:"search_after"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("malformed search %v", err)
+		}
+
+		hits := []interface{}{}
+		for _, doc := range docs {
+			if body.SearchAfter != nil {
+				after, id := int(body.SearchAfter[0].(float64)), body.SearchAfter[1].(string)
+				if doc["updated_at"].(int) < after || doc["updated_at"] == after && doc["_id"].(string) <= id {
+					continue
+				}
+			}
+			if len(hits) == body.Size {
+				break
+			}
+			hits = append(hits, bson.M{
+				"_id":     doc["_id"],
+				"_source": bson.M{"updated_at": doc["updated_at"]},
+				"sort":    []interface{}{doc["updated_at"], doc["_id"]},
+			})
+		}
+		json.NewEncoder(w).Encode(bson.M{"hits": bson.M{"hits": hits}})
+	}))
+}
+
+func TestSearchAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "checkpoint.json")
+
+	// documents that share an updated_at fall on both sides of a page
+	var docs []bson.M
+	for i, updated := range []int{1, 1, 1, 2, 2, 3, 3, 3} {
+		docs = append(docs, bson.M{"_id": fmt.Sprintf("%d", i), "updated_at": updated})
+	}
+	server := fakeESSearch(t, docs)
+	defer server.Close()
+
+	run := func() []string {
+		source := pipe.NewPipe(nil, "source")
+		sink := pipe.NewPipe(source, "sink")
+		go func() {
+			for range source.Err {
+			}
+		}()
+		var ids []string
+		done := make(chan struct{})
+		go func() {
+			sink.Listen(func(msg *message.Msg) (*message.Msg, error) {
+				if msg.Op == message.Insert {
+					ids = append(ids, msg.ID.(string))
+				}
+				return msg, nil
+			})
+			close(done)
+		}()
+
+		a, err := NewElasticsearch(source, "a/b/c", Config{"uri": server.URL, "namespace": "posts.post", "sort": "updated_at", "batch_size": 3, "checkpoint": filename})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		e := a.(*Elasticsearch)
+		e.setupClient()
+		if err := e.searchAfter(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sink.Stop()
+		<-done
+		return ids
+	}
+
+	if ids := run(); !reflect.DeepEqual(ids, []string{"0", "1", "2", "3", "4", "5", "6", "7"}) {
+		t.Errorf("expected every document once, got %v", ids)
+	}
+
+	// resume from the middle of the documents updated at 1
+	c, _ := newCheckpoint(filename)
+	c.Set("search_after", []interface{}{1, "1"})
+	c.Save(true)
+	if ids := run(); !reflect.DeepEqual(ids, []string{"2", "3", "4", "5", "6", "7"}) {
+		t.Errorf("expected the documents after the checkpoint, got %v", ids)
+	}
+
+	var after []interface{}
+	c, _ = newCheckpoint(filename)
+	c.Get("search_after", &after)
+	if !reflect.DeepEqual(after, []interface{}{json.Number("3"), "7"}) && !reflect.DeepEqual(after, []interface{}{float64(3), "7"}) {
+		t.Errorf("expected the last sort key to be checkpointed, got %v", after)
+	}
+}
+
+// esRequest is a request made to a fake elasticsearch server
+type esRequest struct {
+	method, path, body string
+}
+
+func TestElasticsearchMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, body := range map[string]string{"good.json": `{"settings": {"number_of_shards": 1}}`, "bad.json": `{"settings": `} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []struct {
+		mapping string
+		out     interface{}
+		err     string
+	}{
+		{"", nil, ""},
+		{"good.json", map[string]interface{}{"settings": map[string]interface{}{"number_of_shards": float64(1)}}, ""},
+		{"bad.json", nil, "Malformed mapping"},
+		{"missing.json", nil, "Can't read mapping"},
+	}
+
+	for _, v := range data {
+		conf := Config{"uri": "http://localhost:9200", "namespace": "posts.post"}
+		if v.mapping != "" {
+			conf["mapping"] = filepath.Join(dir, v.mapping)
+		}
+		a, err := NewElasticsearch(pipe.NewPipe(nil, "some name"), "a/b/c", conf)
+		if v.err != "" {
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("%s: expected an error about %s, got %v", v.mapping, v.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", v.mapping, err)
+			continue
+		}
+		if mapping := a.(*Elasticsearch).mapping; !reflect.DeepEqual(mapping, v.out) {
+			t.Errorf("%s: expected %v, got %v", v.mapping, v.out, mapping)
+		}
+	}
+}
+
+// fakeESAliases is an elasticsearch that records the requests it's sent.  the posts alias points at
+// posts_20150102150405, unless aliased is false
+func fakeESAliases(aliased bool) (*httptest.Server, func() []esRequest) {
+	var (
+		requests []esRequest
+		lock     sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, esRequest{r.Method, r.URL.Path, string(body)})
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/_alias/posts":
+			if !aliased {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"error": "alias [posts] missing", "status": 404}`)
+				return
+			}
+			fmt.Fprint(w, `{"posts_20150102150405": {"aliases": {"posts": {}}}}`)
+		case "/_bulk":
+			fmt.Fprint(w, `{"errors": false, "items": []}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged": true}`)
+		}
+	}))
+	return server, func() []esRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]esRequest(nil), requests...)
+	}
+}
+
+func TestElasticsearchReindex(t *testing.T) {
+	server, sent := fakeESAliases(true)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := filepath.Join(dir, "mapping.json")
+	if err := ioutil.WriteFile(mapping, []byte(`{"mappings": {"post": {"properties": {"title": {"type": "text"}}}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := pipe.NewPipe(nil, "source")
+	go func() {
+		for err := range source.Err {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+	a, err := NewElasticsearch(pipe.NewPipe(source, "sink"), "a/b/c", Config{"uri": server.URL, "namespace": "posts.post", "reindex": true, "mapping": mapping})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go a.Listen()
+	defer a.Stop()
+
+	done := message.NewCommandMsg(message.CopyComplete, nil)
+	done.Receipt = message.NewReceipt()
+	startCopy(source)
+	source.Send(message.NewMsg(message.Insert, bson.M{"_id": "1", "title": "hello"}))
+	source.Send(done)
+	<-done.Receipt.Done()
+
+	requests := sent()
+	if len(requests) != 5 {
+		t.Fatalf("expected 5 requests, got %v", requests)
+	}
+	if get := requests[0]; get.method != "GET" || get.path != "/_alias/posts" {
+		t.Errorf("expected the alias to be looked up, got %s %s", get.method, get.path)
+	}
+
+	// the copy goes into a new index, named after the time, and created with the mapping
+	create := requests[1]
+	matches := regexp.MustCompile(`^/(posts_\d{14})$`).FindStringSubmatch(create.path)
+	if create.method != "PUT" || matches == nil {
+		t.Fatalf("expected the versioned index to be created, got %s %s", create.method, create.path)
+	}
+	target := matches[1]
+	if create.body != `{"mappings":{"post":{"properties":{"title":{"type":"text"}}}}}` {
+		t.Errorf("expected the index to be created with the mapping, got %s", create.body)
+	}
+
+	if bulk := requests[2]; bulk.path != "/_bulk" || !strings.Contains(bulk.body, `"_index":"`+target+`"`) {
+		t.Errorf("expected the documents to be written to %s, got %s %s", target, bulk.path, bulk.body)
+	}
+	if get := requests[3]; get.method != "GET" || get.path != "/_alias/posts" {
+		t.Errorf("expected the alias to be looked up, got %s %s", get.method, get.path)
+	}
+
+	// the alias moves from the old index to the new one in a single request
+	swap := requests[4]
+	expected := `{"actions":[{"add":{"alias":"posts","index":"` + target + `"}},{"remove":{"alias":"posts","index":"posts_20150102150405"}}]}`
+	if swap.method != "POST" || swap.path != "/_aliases" || swap.body != expected {
+		t.Errorf("expected %s, got %s %s %s", expected, swap.method, swap.path, swap.body)
+	}
+}
+
+func TestElasticsearchReindexResume(t *testing.T) {
+	data := []struct {
+		aliased bool
+		paths   []string // the requests after the alias is looked up
+		index   string   // where the document is written, "" for a new index
+	}{
+		// a source that picks up from a checkpoint doesn't copy, so it's changes go to the index the alias points at
+		{true, []string{"POST /_bulk"}, "posts_20150102150405"},
+		// without an alias, there's nothing to write to but a new index
+		{false, []string{"PUT /posts_", "POST /_bulk"}, ""},
+	}
+
+	for _, v := range data {
+		server, sent := fakeESAliases(v.aliased)
+		source := pipe.NewPipe(nil, "source")
+		a, err := NewElasticsearch(pipe.NewPipe(source, "sink"), "a/b/c", Config{"uri": server.URL, "namespace": "posts.post", "reindex": true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		go a.Listen()
+
+		source.Send(message.NewMsg(message.Insert, bson.M{"_id": "1", "title": "hello"}))
+		waitForSinks(source)
+		a.Stop()
+		server.Close()
+
+		requests := sent()
+		if len(requests) != len(v.paths)+1 {
+			t.Errorf("%t: expected %d requests, got %v", v.aliased, len(v.paths)+1, requests)
+			continue
+		}
+		for i, path := range v.paths {
+			if r := requests[i+1]; !strings.HasPrefix(r.method+" "+r.path, path) {
+				t.Errorf("%t: expected %s, got %s %s", v.aliased, path, r.method, r.path)
+			}
+		}
+		index := a.(*Elasticsearch).target
+		if v.index != "" && index != v.index {
+			t.Errorf("%t: expected the documents to be written to %s, got %s", v.aliased, v.index, index)
+		}
+		if bulk := requests[len(requests)-1]; !strings.Contains(bulk.body, `"_index":"`+index+`"`) {
+			t.Errorf("%t: expected the documents to be written to %s, got %s", v.aliased, index, bulk.body)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package adaptor
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 
+	"github.com/compose/transporter/pkg/extjson"
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 )
@@ -18,6 +18,8 @@ type File struct {
 	pipe       *pipe.Pipe
 	path       string
 	filehandle *os.File
+	mode       extjson.Mode
+	envelope   bool // read and write change-event envelopes, rather than bare documents
 }
 
 // NewFile returns a File Adaptor
@@ -30,11 +32,19 @@ func NewFile(p *pipe.Pipe, path string, extra Config) (StopStartListener, error)
 		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (%s)", err.Error()), nil)
 	}
 
-	return &File{
+	f := &File{
 		uri:  conf.URI,
 		pipe: p,
 		path: path,
-	}, nil
+		mode: extjson.Canonical,
+	}
+	if conf.Relaxed {
+		f.mode = extjson.Relaxed
+	}
+	if f.envelope, err = formatOption(conf.Format); err != nil {
+		return f, NewError(CRITICAL, path, fmt.Sprintf("Can't configure adaptor (%s)", err.Error()), nil)
+	}
+	return f, nil
 }
 
 // Start the file adaptor
@@ -82,16 +92,25 @@ func (d *File) readFile() (err error) {
 		return err
 	}
 
-	decoder := json.NewDecoder(d.filehandle)
+	decoder := extjson.NewDecoder(d.filehandle)
 	for {
-		var doc map[string]interface{}
-		if err := decoder.Decode(&doc); err == io.EOF {
+		doc, err := decoder.Decode()
+		if err == io.EOF {
 			break
 		} else if err != nil {
 			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't marshal document (%s)", err.Error()), nil)
 			return err
 		}
-		d.pipe.Send(message.NewMsg(message.Insert, doc))
+		if !d.envelope {
+			d.pipe.Send(message.NewMsg(message.Insert, doc))
+			continue
+		}
+		e, err := message.EnvelopeFromDocument(doc)
+		if err != nil {
+			d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't read envelope (%s)", err.Error()), doc)
+			continue
+		}
+		d.pipe.Send(e.Msg())
 	}
 	return nil
 }
@@ -100,7 +119,15 @@ func (d *File) readFile() (err error) {
  * dump each message to the file
  */
 func (d *File) dumpMessage(msg *message.Msg) (*message.Msg, error) {
-	jdoc, err := json.Marshal(msg.Document())
+	if msg.Op == message.Command && (!d.envelope || msg.IsCommand(message.Flush) || msg.IsCommand(message.CopyComplete)) {
+		return msg, nil
+	}
+
+	doc := msg.Document()
+	if d.envelope {
+		doc = message.NewEnvelope(msg).Document()
+	}
+	jdoc, err := extjson.Marshal(doc, d.mode)
 	if err != nil {
 		d.pipe.Err <- NewError(ERROR, d.path, fmt.Sprintf("Can't unmarshal document (%s)", err.Error()), msg.Document())
 		return msg, nil
@@ -123,4 +150,14 @@ func (d *File) dumpMessage(msg *message.Msg) (*message.Msg, error) {
 type FileConfig struct {
 	// URI pointing to the resource.  We only recognize file:// and stdout:// currently
 	URI string `json:"uri"`
+
+	// documents are written as canonical extended json, which keeps all of their bson types.
+	// Relaxed writes the more readable relaxed form instead, where 32 and 64 bit integers can't be told apart.
+	// either form can be read back
+	Relaxed bool `json:"relaxed"`
+
+	// Format is either "document" (the default), where each line is a document, or "envelope", where each line is a
+	// change-event envelope describing the operation, as well as the document before and after it.
+	// envelopes are read back as the operations they describe, and the drop, create and rename commands are kept
+	Format string `json:"format"`
 }
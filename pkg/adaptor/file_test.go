@@ -0,0 +1,110 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFileEnvelopeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uri := "file://" + filepath.Join(dir, "out.json")
+
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	update := message.NewMsg(message.Update, bson.M{"_id": id, "views": int64(10)})
+	update.Before = bson.M{"_id": id, "views": int64(9)}
+	in := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": id, "views": int64(9)}),
+		update,
+		message.NewCommandMsg(message.Drop, nil),
+		message.NewMsg(message.Delete, bson.M{"_id": id}), // written by hand below, with only the key
+	}
+	for _, msg := range in {
+		msg.Meta = bson.M{"namespace": "blog.posts"}
+	}
+
+	// write them out, flushes aren't written
+	a, err := NewFile(pipe.NewPipe(nil, "some name"), "a/b/c", Config{"uri": uri, "format": "envelope"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sink := a.(*File)
+	if sink.filehandle, err = os.Create(filepath.Join(dir, "out.json")); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range in[:2] {
+		sink.dumpMessage(msg)
+	}
+	sink.dumpMessage(message.NewCommandMsg(message.Flush, nil))
+	sink.dumpMessage(in[2])
+	sink.filehandle.WriteString(`{"op": "delete", "namespace": "blog.posts", "key": {"$oid": "546656989330a846dc7ce327"}}` + "\n")
+	sink.filehandle.Close()
+
+	// read them back
+	var (
+		source = pipe.NewPipe(nil, "source")
+		out    = pipe.NewPipe(source, "sink")
+		mu     sync.Mutex
+		msgs   []*message.Msg
+	)
+	go func() {
+		for range source.Err {
+		}
+	}()
+	go out.Listen(func(msg *message.Msg) (*message.Msg, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, msg)
+		return msg, nil
+	})
+	defer out.Stop()
+
+	a, err = NewFile(source, "a/b/c", Config{"uri": uri, "format": "envelope"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(msgs)
+		mu.Unlock()
+		if n == len(in) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages, got %d", len(in), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, msg := range msgs {
+		expected := in[i]
+		if msg.Op != expected.Op || !reflect.DeepEqual(msg.ID, expected.ID) || msg.Namespace() != "blog.posts" {
+			t.Errorf("%d: expected %s %v in blog.posts, got %s %v in %s", i, expected.Op, expected.ID, msg.Op, msg.ID, msg.Namespace())
+		}
+		if !reflect.DeepEqual(msg.Document(), expected.Document()) || !reflect.DeepEqual(msg.Before, expected.Before) {
+			t.Errorf("%d: expected %v (before %v), got %v (before %v)", i, expected.Document(), expected.Before, msg.Document(), msg.Before)
+		}
+	}
+	if !msgs[2].IsCommand(message.Drop) {
+		t.Errorf("expected a drop, got %v", msgs[2].Document())
+	}
+}
@@ -0,0 +1,317 @@
+package adaptor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/compose/transporter/pkg/extjson"
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+)
+
+func init() {
+	Register("http", NewHTTP)
+}
+
+// HTTP is an adaptor that posts messages to a webhook, and accepts them from applications.
+// as a sink, each message's document, or it's change-event envelope, is posted as json to a url built from the message,
+// or with a batch size, the messages for the same url are posted together as a json array.  requests that fail with a
+// 5xx or a 429 are retried with a backoff, and the messages that can't be delivered are reported as errors.
+// as a source, it runs a server that accepts posts of documents, or envelopes, and only responds once the sinks have
+// processed them
+type HTTP struct {
+	uri       *template.Template // the url messages are posted to
+	namespace string
+	headers   map[string]string
+	user      string
+	password  string
+	token     string
+	envelope  bool // post change-event envelopes, rather than bare documents
+	mode      extjson.Mode
+	batchSize int
+	retries   int
+	backoff   time.Duration
+	client    *http.Client
+
+	batch    []*message.Msg // the messages waiting to be posted, in the order they arrived
+	batchURI string         // the url the batch is posted to
+
+	listen  string       // the address a source listens on
+	maxBody int64        // the largest body a source accepts
+	server  *http.Server // a source's server, it's created up front so that Stop can close it before Start runs
+	sending sync.Mutex   // keeps the messages from each post together
+
+	pipe *pipe.Pipe
+	path string
+}
+
+// the longest a request is held back between retries
+const httpMaxBackoff = time.Minute
+
+// NewHTTP creates a new HTTP adaptor
+func NewHTTP(p *pipe.Pipe, path string, extra Config) (StopStartListener, error) {
+	var (
+		conf HTTPConfig
+		err  error
+	)
+	if err = extra.Construct(&conf); err != nil {
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't create constructor (%s)", err.Error()), nil)
+	}
+
+	h := &HTTP{
+		namespace: conf.Namespace,
+		headers:   conf.Headers,
+		user:      conf.User,
+		password:  conf.Password,
+		token:     conf.Token,
+		mode:      extjson.Canonical,
+		batchSize: conf.BatchSize,
+		retries:   5,
+		backoff:   time.Second,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		listen:    conf.Listen,
+		maxBody:   conf.MaxBody,
+		pipe:      p,
+		path:      path,
+	}
+	if conf.Relaxed {
+		h.mode = extjson.Relaxed
+	}
+	if h.batchSize <= 0 {
+		h.batchSize = 1
+	}
+	if h.listen == "" {
+		h.listen = ":8080"
+	}
+	if h.maxBody <= 0 {
+		h.maxBody = 16 << 20
+	}
+	h.server = &http.Server{Addr: h.listen, Handler: h}
+	if conf.Retries != nil {
+		h.retries = *conf.Retries
+	}
+	if h.envelope, err = formatOption(conf.Format); err != nil {
+		return h, NewError(CRITICAL, path, fmt.Sprintf("Http error (%s)", err.Error()), nil)
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{{"backoff", conf.Backoff, &h.backoff}, {"timeout", conf.Timeout, &h.client.Timeout}} {
+		if d.value == "" {
+			continue
+		}
+		if *d.to, err = time.ParseDuration(d.value); err != nil || *d.to <= 0 {
+			return h, NewError(CRITICAL, path, fmt.Sprintf("Http error (malformed %s %s)", d.name, d.value), nil)
+		}
+	}
+
+	if conf.URI == "" {
+		return h, nil // a source doesn't need one
+	}
+	if h.uri, err = template.New("uri").Option("missingkey=zero").Parse(conf.URI); err != nil {
+		return h, NewError(CRITICAL, path, fmt.Sprintf("Http error (malformed uri %s)", err.Error()), nil)
+	}
+
+	return h, nil
+}
+
+// Listen starts the listener
+func (h *HTTP) Listen() error {
+	if h.uri == nil {
+		err := fmt.Errorf("no uri")
+		h.pipe.Err <- NewError(CRITICAL, h.path, fmt.Sprintf("Http error (%s)", err.Error()), nil)
+		return err
+	}
+	defer h.flush()
+	return h.pipe.Listen(h.applyOp)
+}
+
+// Stop the adaptor
+func (h *HTTP) Stop() error {
+	h.pipe.Stop()
+	h.server.Close()
+	return nil
+}
+
+// applyOp adds the message to the batch, and posts the batch once it's full.  a message for a different url posts the
+// batch first, so that messages are always posted in order.  flushes post the partial batch.
+// commands are only posted as envelopes
+func (h *HTTP) applyOp(msg *message.Msg) (*message.Msg, error) {
+	if msg.Op == message.Command {
+		if msg.IsCommand(message.Flush) || msg.IsCommand(message.CopyComplete) {
+			h.flush()
+			return msg, nil
+		} else if !h.envelope {
+			return msg, nil
+		}
+	}
+
+	uri, err := executeMessageTemplate(h.uri, msg, h.namespace)
+	if err != nil {
+		h.pipe.Err <- NewError(ERROR, h.path, fmt.Sprintf("Http error (can't build uri %s)", err.Error()), msg.Document())
+		return msg, nil
+	}
+
+	if uri != h.batchURI {
+		h.flush()
+		h.batchURI = uri
+	}
+	h.batch = append(h.batch, msg)
+	if len(h.batch) >= h.batchSize {
+		h.flush()
+	}
+	return msg, nil
+}
+
+// flush posts the batch
+func (h *HTTP) flush() {
+	if len(h.batch) > 0 {
+		h.post(h.batchURI, h.batch)
+	}
+	h.batch = nil
+}
+
+// post sends the messages to the url, retrying while the server is unavailable.  if they can't be delivered, each
+// message is reported as an error
+func (h *HTTP) post(uri string, msgs []*message.Msg) {
+	body, err := h.body(msgs)
+	if err != nil {
+		h.pipe.Err <- NewError(ERROR, h.path, fmt.Sprintf("Http error (%s)", err.Error()), msgs[0].Document())
+		return
+	}
+
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		retry, wait, err := h.send(uri, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= h.retries || h.pipe.Stopped {
+			for _, msg := range msgs {
+				h.pipe.Err <- NewError(ERROR, h.path, fmt.Sprintf("Http error (can't post to %s, %s)", uri, err.Error()), msg.Document())
+			}
+			return
+		}
+
+		if wait < 0 {
+			wait = backoff
+			if backoff *= 2; backoff > httpMaxBackoff {
+				backoff = httpMaxBackoff
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// send makes one attempt to post the body.  failures that are worth retrying are reported, along with how long the
+// server asked us to wait first, or -1 if it didn't say
+func (h *HTTP) send(uri string, body []byte) (retry bool, wait time.Duration, err error) {
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return false, -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	if h.user != "" {
+		req.SetBasicAuth(h.user, h.password)
+	} else if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, -1, err
+	}
+	defer resp.Body.Close()
+	text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		wait = -1
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			if wait = time.Duration(seconds) * time.Second; wait > httpMaxBackoff {
+				wait = httpMaxBackoff
+			}
+		}
+		return true, wait, fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(text))
+	}
+	return false, -1, fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(text))
+}
+
+// body encodes the messages, a single message is posted as an object, and a batch as an array
+func (h *HTTP) body(msgs []*message.Msg) ([]byte, error) {
+	docs := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		docs[i] = msg.Document()
+		if h.envelope {
+			e := message.NewEnvelope(msg)
+			if e.Namespace == "" {
+				e.Namespace = h.namespace
+			}
+			docs[i] = e.Document()
+		}
+	}
+	if h.batchSize == 1 {
+		return extjson.Marshal(docs[0], h.mode)
+	}
+	return extjson.Marshal(docs, h.mode)
+}
+
+// HTTPConfig provides configuration options for an http adaptor
+type HTTPConfig struct {
+	// URI is a template for the url a sink posts messages to, filled in with the message's .Op, .Namespace, .ID and
+	// .Doc, ie. https://example.com/hooks/{{.Namespace}}
+	URI       string `json:"uri"`
+	Namespace string `json:"namespace"` // the namespace of messages from sources that don't say which namespace they came from
+	Debug     bool   `json:"debug"`     // debug mode
+
+	// Headers are added to every request
+	Headers map[string]string `json:"headers"`
+
+	// User and Password authenticate with basic auth, or Token authenticates as a bearer token.
+	// a source only accepts requests that authenticate with them
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+
+	// BatchSize is how many messages are posted together, as a json array.  it defaults to 1, where each message is
+	// posted on it's own, as a json object.  consecutive messages for the same url are posted together, a message for
+	// a different url posts the batch early.  partial batches are posted on a flush
+	BatchSize int `json:"batch_size"`
+
+	// Retries is how many times a request that failed with a 5xx, a 429, or without a response, is retried.
+	// it defaults to 5.  Backoff is how long to wait before the first retry, doubling each time, unless the server
+	// says how long with Retry-After.  it defaults to 1s
+	Retries *int   `json:"retries"`
+	Backoff string `json:"backoff"`
+
+	// Timeout is how long to wait for a response, it defaults to 30s
+	Timeout string `json:"timeout"`
+
+	// Format is either "document" (the default), where each message is the document, or "envelope", where each
+	// message is a change-event envelope describing the operation, as well as the document before and after it.
+	// a source turns documents into inserts, and envelopes into the operations they describe
+	Format string `json:"format"`
+
+	// Listen is the address a source listens on, it defaults to :8080
+	Listen string `json:"listen"`
+
+	// MaxBody is the largest body, in bytes, that a source accepts.  it defaults to 16MB
+	MaxBody int64 `json:"max_body"`
+
+	// documents are written as canonical extended json, which keeps all of their bson types.
+	// Relaxed writes the more readable relaxed form instead
+	Relaxed bool `json:"relaxed"`
+}
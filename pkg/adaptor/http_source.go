@@ -0,0 +1,175 @@
+package adaptor
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/compose/transporter/pkg/extjson"
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Start the adaptor as a source.  the server accepts posts until the adaptor is stopped, if it's already been stopped,
+// Start returns straight away
+func (h *HTTP) Start() (err error) {
+	defer func() {
+		h.pipe.Stop()
+	}()
+
+	if err = h.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		h.pipe.Err <- NewError(CRITICAL, h.path, fmt.Sprintf("Http error (%s)", err.Error()), nil)
+		return err
+	}
+	return nil
+}
+
+// ServeHTTP accepts a post of documents, or envelopes, either as a json array, or as a stream of json objects,
+// ie. newline delimited json.  the whole body is read before anything is sent down the pipeline, so a malformed body
+// is rejected without any of it being sent.  the response waits until every sink has processed the messages
+func (h *HTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpReply(w, http.StatusMethodNotAllowed, bson.M{"error": "only POST is supported"})
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="transporter"`)
+		httpReply(w, http.StatusUnauthorized, bson.M{"error": "unauthorized"})
+		return
+	}
+
+	docs, err := httpDocuments(http.MaxBytesReader(w, r.Body, h.maxBody))
+	if err != nil {
+		httpReply(w, http.StatusBadRequest, bson.M{"error": err.Error()})
+		return
+	}
+	msgs := make([]*message.Msg, len(docs))
+	for i, doc := range docs {
+		if msgs[i], err = h.message(doc); err != nil {
+			httpReply(w, http.StatusBadRequest, bson.M{"error": fmt.Sprintf("document %d, %s", i, err.Error())})
+			return
+		}
+	}
+
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	h.sending.Lock()
+	for _, msg := range msgs {
+		h.pipe.Send(msg)
+	}
+	h.pipe.Send(flush)
+	h.sending.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-flush.Receipt.Done():
+			httpReply(w, http.StatusOK, bson.M{"count": len(msgs)})
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if h.pipe.Stopped {
+				httpReply(w, http.StatusServiceUnavailable, bson.M{"error": "transporter is stopping"})
+				return
+			}
+		}
+	}
+}
+
+// authorized checks the request's credentials, if the adaptor has been configured with any
+func (h *HTTP) authorized(r *http.Request) bool {
+	switch {
+	case h.user != "":
+		user, password, ok := r.BasicAuth()
+		return ok && subtle.ConstantTimeCompare([]byte(user), []byte(h.user)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) == 1
+	case h.token != "":
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) == 1
+	}
+	return true
+}
+
+// message turns a posted document into a message, documents are inserts, and envelopes are the operations they
+// describe.  messages take the adaptor's namespace if they don't have one of their own
+func (h *HTTP) message(doc bson.M) (*message.Msg, error) {
+	msg := message.NewMsg(message.Insert, doc)
+	if h.envelope {
+		e, err := message.EnvelopeFromDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		msg = e.Msg()
+	}
+	if msg.Namespace() == "" && h.namespace != "" {
+		if msg.Meta == nil {
+			msg.Meta = bson.M{}
+		}
+		msg.Meta["namespace"] = h.namespace
+	}
+	return msg, nil
+}
+
+// httpDocuments reads the documents in a body, which is either a json array of them, or a stream of them
+func httpDocuments(body io.Reader) ([]bson.M, error) {
+	br := bufio.NewReader(body)
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		br.ReadByte()
+	}
+
+	var docs []bson.M
+	if b, _ := br.Peek(1); b[0] == '[' {
+		var values []interface{}
+		dec := json.NewDecoder(br)
+		dec.UseNumber()
+		if err := dec.Decode(&values); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			doc, err := extjson.Decode(v)
+			if err != nil {
+				return nil, fmt.Errorf("document %d, %s", i, err.Error())
+			}
+			m, ok := doc.(bson.M)
+			if !ok {
+				return nil, fmt.Errorf("document %d, expected a document, got %T", i, doc)
+			}
+			docs = append(docs, m)
+		}
+		return docs, nil
+	}
+
+	dec := extjson.NewDecoder(br)
+	for {
+		doc, err := dec.Decode()
+		if err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d, %s", len(docs), err.Error())
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// httpReply writes a json response
+func httpReply(w http.ResponseWriter, status int, body bson.M) {
+	ba, _ := extjson.Marshal(body, extjson.Relaxed)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(ba)
+}
@@ -0,0 +1,324 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// httpRequests is a webhook that records what it's sent, and answers with the statuses in replies before it succeeds
+type httpRequests struct {
+	sync.Mutex
+	replies []int
+	paths   []string
+	bodies  []string
+	auth    []string
+	headers []string
+}
+
+func (h *httpRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	h.paths = append(h.paths, r.URL.Path)
+	h.bodies = append(h.bodies, string(body))
+	h.auth = append(h.auth, r.Header.Get("Authorization"))
+	h.headers = append(h.headers, r.Header.Get("X-Source"))
+	if len(h.replies) > 0 {
+		status := h.replies[0]
+		h.replies = h.replies[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("try again"))
+	}
+}
+
+func TestHTTPPost(t *testing.T) {
+	hook := &httpRequests{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	a, err := NewHTTP(pipe.NewPipe(nil, "some name"), "a/b/c", Config{
+		"uri":       server.URL + "/hooks/{{.Namespace}}/{{.ID}}",
+		"namespace": "blog.posts",
+		"headers":   map[string]interface{}{"X-Source": "transporter"},
+		"token":     "secret",
+		"relaxed":   true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := a.(*HTTP)
+
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "a", "title": "hello"}))
+	h.applyOp(message.NewCommandMsg(message.Drop, nil)) // only posted as an envelope
+
+	if !reflect.DeepEqual(hook.paths, []string{"/hooks/blog.posts/a"}) {
+		t.Errorf("unexpected paths %v", hook.paths)
+	}
+	if !reflect.DeepEqual(hook.bodies, []string{`{"_id":"a","title":"hello"}`}) {
+		t.Errorf("unexpected bodies %v", hook.bodies)
+	}
+	if hook.auth[0] != "Bearer secret" || hook.headers[0] != "transporter" {
+		t.Errorf("expected the token and the header, got %s %s", hook.auth[0], hook.headers[0])
+	}
+}
+
+func TestHTTPBatches(t *testing.T) {
+	hook := &httpRequests{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	a, err := NewHTTP(pipe.NewPipe(nil, "some name"), "a/b/c", Config{
+		"uri":        server.URL + "/{{.Namespace}}",
+		"user":       "user",
+		"password":   "pass",
+		"batch_size": 2,
+		"format":     "envelope",
+		"relaxed":    true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := a.(*HTTP)
+
+	for i, ns := range []string{"blog.posts", "blog.posts", "blog.posts"} {
+		msg := message.NewMsg(message.Insert, bson.M{"_id": i})
+		msg.Timestamp = 0
+		msg.Meta = bson.M{"namespace": ns}
+		h.applyOp(msg)
+	}
+	if len(hook.bodies) != 1 {
+		t.Fatalf("expected the full batch to be posted, got %v", hook.bodies)
+	}
+	h.applyOp(message.NewCommandMsg(message.Flush, nil))
+
+	if !reflect.DeepEqual(hook.paths, []string{"/blog.posts", "/blog.posts"}) {
+		t.Errorf("unexpected paths %v", hook.paths)
+	}
+	expected := []string{
+		`[{"after":{"_id":0},"before":null,"key":0,"namespace":"blog.posts","op":"insert","partial":false,"ts":0},{"after":{"_id":1},"before":null,"key":1,"namespace":"blog.posts","op":"insert","partial":false,"ts":0}]`,
+		`[{"after":{"_id":2},"before":null,"key":2,"namespace":"blog.posts","op":"insert","partial":false,"ts":0}]`,
+	}
+	if !reflect.DeepEqual(hook.bodies, expected) {
+		t.Errorf("expected %v, got %v", expected, hook.bodies)
+	}
+	if !strings.HasPrefix(hook.auth[0], "Basic ") {
+		t.Errorf("expected basic auth, got %s", hook.auth[0])
+	}
+}
+
+func TestHTTPBatchOrder(t *testing.T) {
+	hook := &httpRequests{}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	a, err := NewHTTP(pipe.NewPipe(nil, "some name"), "a/b/c", Config{
+		"uri":        server.URL + "/{{.Op}}",
+		"namespace":  "blog.posts",
+		"batch_size": 10,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := a.(*HTTP)
+
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "a"}))
+	h.applyOp(message.NewMsg(message.Update, bson.M{"_id": "a", "title": "hello"}))
+	h.applyOp(message.NewMsg(message.Update, bson.M{"_id": "b"}))
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "c"}))
+	h.applyOp(message.NewCommandMsg(message.Flush, nil))
+
+	// the insert is posted before the updates, even though the batch wasn't full
+	if !reflect.DeepEqual(hook.paths, []string{"/insert", "/update", "/insert"}) {
+		t.Errorf("unexpected paths %v", hook.paths)
+	}
+	expected := []string{
+		`[{"_id":"a"}]`,
+		`[{"_id":"a","title":"hello"},{"_id":"b"}]`,
+		`[{"_id":"c"}]`,
+	}
+	if !reflect.DeepEqual(hook.bodies, expected) {
+		t.Errorf("expected %v, got %v", expected, hook.bodies)
+	}
+}
+
+func TestHTTPRetries(t *testing.T) {
+	hook := &httpRequests{replies: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	p := pipe.NewPipe(nil, "some name")
+	errs := make(chan error, 10)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+
+	a, err := NewHTTP(p, "a/b/c", Config{"uri": server.URL, "backoff": "1ms", "retries": 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := a.(*HTTP)
+
+	// a 503 and a 429 are retried
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "a"}))
+	if len(hook.bodies) != 3 || len(errs) != 0 {
+		t.Errorf("expected the post to succeed on the third attempt, got %d attempts and %d errors", len(hook.bodies), len(errs))
+	}
+
+	// a 400 isn't
+	hook.replies = []int{http.StatusBadRequest}
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "b"}))
+	// and neither is a 500 once we're out of retries
+	hook.replies = []int{500, 500, 500}
+	h.applyOp(message.NewMsg(message.Insert, bson.M{"_id": "c"}))
+	if len(hook.bodies) != 7 {
+		t.Errorf("expected 7 attempts, got %d", len(hook.bodies))
+	}
+
+	var failed []string
+	for i := 0; i < 2; i++ {
+		e, ok := (<-errs).(Error)
+		if !ok || e.Lvl != ERROR || !strings.Contains(e.Str, "try again") {
+			t.Errorf("unexpected error %+v", e)
+			continue
+		}
+		failed = append(failed, e.Record["_id"].(string))
+	}
+	sort.Strings(failed)
+	if !reflect.DeepEqual(failed, []string{"b", "c"}) {
+		t.Errorf("expected b and c to fail, got %v", failed)
+	}
+}
+
+func TestHTTPDocuments(t *testing.T) {
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	data := []struct {
+		in   string
+		docs []bson.M
+		err  bool
+	}{
+		{`[{"_id": 1}, {"_id": {"$oid": "546656989330a846dc7ce327"}, "n": 1.5}]`, []bson.M{{"_id": 1}, {"_id": id, "n": 1.5}}, false},
+		{"{\"_id\": 1}\n{\"_id\": 2}\n", []bson.M{{"_id": 1}, {"_id": 2}}, false},
+		{"  \n [] ", nil, false},
+		{"", nil, false},
+		{`{"_id": 1}`, []bson.M{{"_id": 1}}, false},
+		{`[{"_id": 1}, 2]`, nil, true},
+		{"{\"_id\": 1}\n{\"_id\": ", nil, true},
+	}
+
+	for _, v := range data {
+		docs, err := httpDocuments(strings.NewReader(v.in))
+		if (err != nil) != v.err {
+			t.Errorf("%q: expected error %t, got %v", v.in, v.err, err)
+			continue
+		}
+		if !v.err && len(docs)+len(v.docs) > 0 && !reflect.DeepEqual(docs, v.docs) {
+			t.Errorf("%q: expected %v, got %v", v.in, v.docs, docs)
+		}
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	var (
+		source = pipe.NewPipe(nil, "source")
+		out    = pipe.NewPipe(source, "sink")
+		mu     sync.Mutex
+		msgs   []*message.Msg
+	)
+	go func() {
+		for range source.Err {
+		}
+	}()
+	go out.Listen(func(msg *message.Msg) (*message.Msg, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if msg.Op != message.Command {
+			msgs = append(msgs, msg)
+		}
+		return msg, nil
+	})
+	defer out.Stop()
+
+	a, err := NewHTTP(source, "a/b/c", Config{"namespace": "blog.posts", "token": "secret", "format": "envelope"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h := a.(*HTTP)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	post := func(body, token string) (int, string) {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		ba, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(ba)
+	}
+
+	if status, _ := post(`{"op": "insert", "after": {"_id": 1}}`, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected a 401, got %d", status)
+	}
+	if status, body := post(`[{"op": "insert", "after": {"_id": 1}}, {"op": "nope"}]`, "secret"); status != http.StatusBadRequest || !strings.Contains(body, "document 1") {
+		t.Errorf("expected a 400 about document 1, got %d %s", status, body)
+	}
+
+	status, body := post("{\"op\": \"insert\", \"after\": {\"_id\": 1, \"name\": \"a\"}}\n{\"op\": \"delete\", \"namespace\": \"blog.drafts\", \"key\": 2}\n", "secret")
+	if status != http.StatusOK || body != `{"count":2}` {
+		t.Errorf("expected a 200, got %d %s", status, body)
+	}
+
+	// the response waits for the sink, so the messages are already there
+	mu.Lock()
+	defer mu.Unlock()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Op != message.Insert || msgs[0].ID != 1 || msgs[0].Namespace() != "blog.posts" {
+		t.Errorf("unexpected message %s %v %v", msgs[0].Op, msgs[0].ID, msgs[0].Meta)
+	}
+	if msgs[1].Op != message.Delete || msgs[1].ID != 2 || msgs[1].Namespace() != "blog.drafts" {
+		t.Errorf("unexpected message %s %v %v", msgs[1].Op, msgs[1].ID, msgs[1].Meta)
+	}
+}
+
+func TestHTTPStopBeforeStart(t *testing.T) {
+	a, err := NewHTTP(pipe.NewPipe(nil, "source"), "a/b/c", Config{"listen": "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Start()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		a.Stop()
+		t.Errorf("expected Start to return once the adaptor had been stopped")
+	}
+}
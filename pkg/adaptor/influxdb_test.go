@@ -0,0 +1,127 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestInfluxPoint(t *testing.T) {
+	ts := time.Date(2015, 6, 11, 20, 46, 2, 0, time.UTC)
+
+	data := []struct {
+		extra Config
+		doc   bson.M
+		out   string
+		err   bool
+	}{
+		{
+			Config{"tags": []string{"region", "host"}, "time": "ts"},
+			bson.M{"host": "server 01", "region": "us-west", "load": 0.64, "cores": 4, "ts": ts},
+			"cpu,host=server\\ 01,region=us-west cores=4i,load=0.64 1434055562000\n",
+			false,
+		},
+		{
+			Config{"fields": []string{"load"}, "time": "ts", "precision": "s", "measurement": "cpu_{{.region}}"},
+			bson.M{"region": "eu", "load": 1.0, "cores": 4, "ts": ts},
+			"cpu_eu load=1 1434055562\n",
+			false,
+		},
+		{
+			Config{},
+			bson.M{"name": `say "hi"`, "ok": true, "nested": bson.M{"a": 1}},
+			"cpu name=\"say \\\"hi\\\"\",ok=true\n",
+			false,
+		},
+		{
+			Config{"time": "ts", "precision": "n"},
+			bson.M{"load": 1.5, "ts": int64(1434055562123456789)},
+			"cpu load=1.5 1434055562123456789\n",
+			false,
+		},
+		{
+			Config{"tags": []string{"host"}},
+			bson.M{"host": "server01"},
+			"",
+			true,
+		},
+	}
+
+	for _, v := range data {
+		v.extra["uri"] = "http://localhost:8086"
+		v.extra["namespace"] = "metrics.cpu"
+		a, err := NewInfluxdb(pipe.NewPipe(nil, "some name"), "a/b/c", v.extra)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", v.extra, err)
+			continue
+		}
+		out, err := a.(*Influxdb).point(v.doc)
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error: %t, got: %v", v.doc, v.err, err)
+			continue
+		}
+		if string(out) != v.out {
+			t.Errorf("%v: expected: %q, got: %q", v.doc, v.out, out)
+		}
+	}
+}
+
+func TestInfluxApplyOp(t *testing.T) {
+	var (
+		requests []string
+		lock     sync.Mutex
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, r.URL.Path+" "+r.URL.Query().Get("q")+strings.TrimSpace(string(body)))
+		lock.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	p := pipe.NewPipe(nil, "some name")
+	errs := make(chan error, 10)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+	a, err := NewInfluxdb(p, "a/b/c", Config{"uri": server.URL, "namespace": "metrics.cpu", "tags": []string{"host"}, "time": "ts", "precision": "s"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	i := a.(*Influxdb)
+
+	partial := message.NewMsg(message.Update, bson.M{"_id": 1, "load": 2.0})
+	partial.Partial = true
+	i.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1, "host": "a", "load": 1.0, "ts": 10}))
+	i.applyOp(message.NewMsg(message.Delete, bson.M{"_id": 1, "host": "a", "ts": 10}))
+	i.applyOp(partial)
+	i.applyOp(message.NewCommandMsg(message.Flush, nil))
+
+	// the insert is written before the delete, so the point stays deleted
+	expected := []string{"/write cpu,host=a _id=1i,load=1 10", "/query DELETE FROM \"cpu\" WHERE time = 10s AND \"host\" = 'a'"}
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, requests)
+	}
+
+	select {
+	case err := <-errs:
+		if e, ok := err.(Error); !ok || e.Lvl != ERROR || !strings.Contains(e.Str, "partial") {
+			t.Errorf("expected an error for the partial update, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error for the partial update")
+	}
+}
@@ -0,0 +1,138 @@
+package adaptor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/compose/transporter/pkg/extjson"
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseKafkaURI(t *testing.T) {
+	data := []struct {
+		in       string
+		brokers  []string
+		user     string
+		password string
+	}{
+		{"kafka://localhost:9092", []string{"localhost:9092"}, "", ""},
+		{"kafka://user:p@ss@broker1:9092,broker2:9093/", []string{"broker1:9092", "broker2:9093"}, "user", "p@ss"},
+		{"broker1:9092, broker2:9092", []string{"broker1:9092", "broker2:9092"}, "", ""},
+	}
+
+	for _, v := range data {
+		brokers, user, password := parseKafkaURI(v.in)
+		if !reflect.DeepEqual(brokers, v.brokers) || user != v.user || password != v.password {
+			t.Errorf("%s: expected %v %s %s, got %v %s %s", v.in, v.brokers, v.user, v.password, brokers, user, password)
+		}
+	}
+}
+
+func TestKafkaMessageRoundTrip(t *testing.T) {
+	a, err := NewKafka(pipe.NewPipe(nil, "some name"), "a/b/c", Config{"uri": "kafka://localhost:9092", "namespace": "posts", "topic": "cdc.{{.Namespace}}.{{.Op}}"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	k := a.(*Kafka)
+
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	msg := message.NewMsg(message.Update, bson.M{"_id": id, "title": "hello", "views": int64(10)})
+	msg.Partial = true
+	msg.Meta = bson.M{"namespace": "blog.posts"}
+
+	pm, err := k.producerMessage(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pm.Topic != "cdc.blog.posts.update" {
+		t.Errorf("expected topic cdc.blog.posts.update, got %s", pm.Topic)
+	}
+	if key, _ := pm.Key.Encode(); string(key) != id.Hex() {
+		t.Errorf("expected key %s, got %s", id.Hex(), key)
+	}
+
+	value, _ := pm.Value.Encode()
+	headers := make([]*sarama.RecordHeader, len(pm.Headers))
+	for i := range pm.Headers {
+		headers[i] = &pm.Headers[i]
+	}
+	out, err := kafkaMessage(&sarama.ConsumerMessage{Topic: pm.Topic, Partition: 2, Offset: 100, Value: value, Headers: headers}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Op != message.Update || !out.Partial || out.ID != id {
+		t.Errorf("expected a partial update of %v, got %s %v (partial %t)", id, out.Op, out.ID, out.Partial)
+	}
+	if !reflect.DeepEqual(out.Document(), msg.Document()) {
+		t.Errorf("expected %v, got %v", msg.Document(), out.Document())
+	}
+	if out.Meta["namespace"] != "blog.posts" || out.Meta["offset"] != int64(100) || out.Meta["partition"] != 2 {
+		t.Errorf("unexpected meta %v", out.Meta)
+	}
+
+	// a plain json message is an insert, with it's id from the key
+	out, err = kafkaMessage(&sarama.ConsumerMessage{Key: []byte("abc"), Value: []byte(`{"title": "hello"}`)}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Op != message.Insert || out.ID != "abc" {
+		t.Errorf("expected an insert of abc, got %s %v", out.Op, out.ID)
+	}
+}
+
+func TestKafkaEnvelope(t *testing.T) {
+	a, err := NewKafka(pipe.NewPipe(nil, "some name"), "a/b/c", Config{"uri": "kafka://localhost:9092", "namespace": "posts", "format": "envelope"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	k := a.(*Kafka)
+
+	msg := message.NewMsg(message.Update, bson.M{"_id": "abc", "title": "after"})
+	msg.Before = bson.M{"_id": "abc", "title": "before"}
+	msg.Meta = bson.M{"namespace": "blog.posts", "lsn": "0/16B3748"}
+
+	pm, err := k.producerMessage(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	value, _ := pm.Value.Encode()
+	doc, err := message.EnvelopeFromDocument(mustUnmarshal(t, value))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Op != message.Update || doc.Namespace != "blog.posts" || doc.Before["title"] != "before" || doc.After["title"] != "after" || doc.Position["lsn"] != "0/16B3748" {
+		t.Errorf("unexpected envelope %+v", doc)
+	}
+
+	out, err := kafkaMessage(&sarama.ConsumerMessage{Topic: pm.Topic, Offset: 7, Value: value}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Op != message.Update || out.ID != "abc" || out.Before["title"] != "before" || out.Namespace() != "blog.posts" || out.Meta["offset"] != int64(7) {
+		t.Errorf("unexpected message %s %v %v %v", out.Op, out.ID, out.Before, out.Meta)
+	}
+
+	// a delete described by it's key alone, takes the key from the message
+	out, err = kafkaMessage(&sarama.ConsumerMessage{Key: []byte("abc"), Value: []byte(`{"op": "delete", "before": null, "after": null}`)}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out.Op != message.Delete || out.ID != "abc" {
+		t.Errorf("expected a delete of abc, got %s %v", out.Op, out.ID)
+	}
+
+	if _, err := kafkaMessage(&sarama.ConsumerMessage{Value: []byte(`{"title": "hello"}`)}, true); err == nil {
+		t.Errorf("expected an error for a document that isn't an envelope")
+	}
+}
+
+func mustUnmarshal(t *testing.T, data []byte) bson.M {
+	doc, err := extjson.Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return doc
+}
@@ -3,8 +3,11 @@ package adaptor
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/extjson"
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 	"gopkg.in/mgo.v2"
@@ -23,7 +26,16 @@ type Mongodb struct {
 	collection string
 	database   string
 
-	oplogTime bson.MongoTimestamp
+	oplogs     []*oplog    // the oplogs we're tailing, one for each shard
+	copied     int         // the number of documents copied
+	checkpoint *checkpoint // where the position in the oplogs is saved
+	marks      []mongoMark // positions that are waiting for the sinks to catch up
+
+	commands string // what to do with commands when used as a sink
+
+	// optional filter and projection applied to both the copy and the tail
+	query      bson.M
+	projection bson.M
 
 	//
 	pipe *pipe.Pipe
@@ -64,11 +76,31 @@ func NewMongodb(p *pipe.Pipe, path string, extra Config) (StopStartListener, err
 		path:         path,
 	}
 
+	m.commands, err = commandsOption(conf.Commands)
+	if err != nil {
+		return m, err
+	}
+
 	m.database, m.collection, err = m.splitNamespace(conf.Namespace)
 	if err != nil {
 		return m, err
 	}
 
+	m.query, err = parseMongoDocument(conf.Query)
+	if err != nil {
+		return m, fmt.Errorf("malformed query (%s)", err.Error())
+	}
+
+	m.projection, err = parseMongoDocument(conf.Projection)
+	if err != nil {
+		return m, fmt.Errorf("malformed projection (%s)", err.Error())
+	}
+
+	m.checkpoint, err = newCheckpoint(conf.Checkpoint)
+	if err != nil {
+		return m, fmt.Errorf("can't load checkpoint (%s)", err.Error())
+	}
+
 	m.mongoSession, err = mgo.Dial(m.uri)
 	return m, err
 }
@@ -76,19 +108,44 @@ func NewMongodb(p *pipe.Pipe, path string, extra Config) (StopStartListener, err
 // Start the adaptor as a source
 func (m *Mongodb) Start() (err error) {
 	defer func() {
+		m.closeOplogs()
 		m.pipe.Stop()
 	}()
 
-	m.oplogTime = nowAsMongoTimestamp()
-	if m.debug {
-		fmt.Printf("setting start timestamp: %d", m.oplogTime)
+	resumed := false
+	if m.tail {
+		// find the oplogs we'll tail, and start from the newest operation in each
+		if m.oplogs, err = m.discoverOplogs(); err != nil {
+			m.pipe.Err <- NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't read oplog %s)", err.Error()), nil)
+			return err
+		}
+		if resumed, err = m.restoreCheckpoint(); err != nil {
+			m.pipe.Err <- NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't restore checkpoint %s)", err.Error()), nil)
+			return err
+		}
+	}
+	for _, o := range m.oplogs {
+		if m.debug {
+			fmt.Printf("setting start timestamp for %s: %d\n", o.name, o.ts)
+		}
+		o.snapshot = newSnapshot(o.ts)
 	}
 
-	err = m.catData()
-	if err != nil {
-		m.pipe.Err <- err
-		return err
+	// if we're picking up from a checkpoint, the sinks already have the copy
+	if !resumed {
+		startCopy(m.pipe)
+		err = m.catData()
+		if err != nil {
+			m.pipe.Err <- err
+			return err
+		}
+		if m.pipe.Stopped {
+			return
+		}
+
+		m.copyComplete()
 	}
+
 	if m.tail {
 		// replay the oplog
 		err = m.tailData()
@@ -119,6 +176,13 @@ func (m *Mongodb) Stop() error {
 // TODO this can be cleaned up.  I'm not sure whether this should pipe the error, or whether the
 //   caller should pipe the error
 func (m *Mongodb) writeMessage(msg *message.Msg) (*message.Msg, error) {
+	if msg.Op == message.Command {
+		if err := m.runCommand(msg); err != nil {
+			m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), msg.Document())
+		}
+		return msg, nil
+	}
+
 	collection := m.mongoSession.DB(m.database).C(m.collection)
 	err := collection.Insert(msg.Document())
 	if mgo.IsDup(err) {
@@ -130,57 +194,342 @@ func (m *Mongodb) writeMessage(msg *message.Msg) (*message.Msg, error) {
 	return msg, nil
 }
 
-// catdata pulls down the original collection
+// runCommand applies a command from the source to the destination collection, according to the commands option
+func (m *Mongodb) runCommand(msg *message.Msg) error {
+	c, arg, ok := msg.Command()
+	if !ok || c == message.Flush || c == message.CopyComplete { // writes aren't buffered, nothing to flush
+		return nil
+	}
+
+	switch m.commands {
+	case commandsIgnore:
+		return nil
+	case commandsWarn:
+		m.pipe.Err <- commandWarning(m.path, c, arg)
+		return nil
+	}
+
+	db := m.mongoSession.DB(m.database)
+	switch c {
+	case message.Drop:
+		err := db.C(m.collection).DropCollection()
+		if err != nil && err.Error() == "ns not found" {
+			return nil
+		}
+		return err
+	case message.Create:
+		err := db.C(m.collection).Create(&mgo.CollectionInfo{})
+		if err != nil && strings.Contains(err.Error(), "already exists") {
+			return nil
+		}
+		return err
+	case message.Rename:
+		to, ok := arg.(string)
+		if !ok {
+			return fmt.Errorf("malformed rename (%v)", arg)
+		}
+		_, collection, err := m.splitNamespace(to)
+		if err != nil {
+			return err
+		}
+		cmd := bson.D{{Name: "renameCollection", Value: m.getNamespace()}, {Name: "to", Value: m.database + "." + collection}}
+		if err = m.mongoSession.Run(cmd, nil); err != nil {
+			return err
+		}
+		m.collection = collection
+	}
+	return nil
+}
+
+// catdata pulls down the original collection.
+// the collection is read a page at a time, in _id order, and the progress of the copy is marked against the oplog as each
+// page is fetched, rather than as documents are sent, so that a mark never claims the copy had read less than it had.
+// nothing past the end of a page has been read until the next page is queried
 func (m *Mongodb) catData() (err error) {
 	var (
 		collection = m.mongoSession.DB(m.database).C(m.collection)
-		query      = bson.M{}
-		result     bson.M // hold the document
+		cursor     = &copyCursor{}
+		lastID     interface{}
+		meta       = m.copyMeta()
 	)
 
-	iter := collection.Find(query).Sort("_id").Iter()
-
 	for {
-		for iter.Next(&result) {
+		var page []bson.M
+		err = collection.Find(cursor.query(m.copyQuery())).Select(m.projection).Sort("_id").Limit(snapshotMarkInterval).Batch(snapshotMarkInterval).All(&page)
+		// check here if we've been asked to quit
+		if stop := m.pipe.Stopped; stop {
+			return nil
+		}
+		if err != nil {
+			if !m.restartable {
+				return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading collection %s)", err.Error()), nil)
+			}
+			fmt.Printf("got err reading collection. reissuing query %v\n", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		var more bool
+		if page, more, err = cursor.next(page, snapshotMarkInterval); err != nil {
+			return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
+		}
+		if len(page) == 0 {
+			if more {
+				continue
+			}
+			return m.markSnapshot(lastID)
+		}
+
+		lastID = page[len(page)-1]["_id"]
+		if err = m.markSnapshot(lastID); err != nil {
+			return err
+		}
+
+		for _, result := range page {
 			if stop := m.pipe.Stopped; stop {
-				return
+				return nil
 			}
 
 			// set up the message
 			msg := message.NewMsg(message.Insert, result)
-
+			msg.Meta = meta
 			m.pipe.Send(msg)
-			result = bson.M{}
+			m.copied++
 		}
+	}
+}
 
-		// we've exited the mongo read loop, lets figure out why
-		// check here again if we've been asked to quit
-		if stop := m.pipe.Stopped; stop {
-			return
+// copyComplete signals the end of the copy.  a message.CopyComplete command is sent to the sinks, and a
+// snapshot event is emitted with the number of documents that were copied and the position of each oplog when the copy finished
+func (m *Mongodb) copyComplete() {
+	m.pipe.Send(message.NewCommandMsg(message.CopyComplete, nil))
+	m.pipe.Event <- events.NewSnapshotEvent(time.Now().Unix(), m.path, m.copied, m.oplogPosition())
+}
+
+// copyMeta is the metadata for copied documents.  when tailing, the ts is the earliest oplog position the copy started at,
+// so that it sorts before the ts of any operation read from the oplog afterwards
+func (m *Mongodb) copyMeta() bson.M {
+	if len(m.oplogs) == 0 {
+		return bson.M{"namespace": m.getNamespace()}
+	}
+	ts := m.oplogs[0].snapshot.marks[0].ts
+	for _, o := range m.oplogs[1:] {
+		if o.snapshot.marks[0].ts < ts {
+			ts = o.snapshot.marks[0].ts
 		}
+	}
+	return bson.M{"namespace": m.getNamespace(), "ts": int64(ts)}
+}
 
-		if iter.Err() != nil && m.restartable {
-			fmt.Printf("got err reading collection. reissuing query %v\n", iter.Err())
-			time.Sleep(1 * time.Second)
-			iter = collection.Find(query).Sort("_id").Iter()
-			continue
+// markSnapshot records how far the copy has progressed at the current position of each oplog
+func (m *Mongodb) markSnapshot(lastID interface{}) error {
+	for _, o := range m.oplogs {
+		ts, err := lastOplogTimestamp(o.session)
+		if err != nil {
+			return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (can't read oplog %s)", err.Error()), nil)
+		}
+		o.snapshot.mark(ts, lastID)
+	}
+	return nil
+}
+
+// oplogPosition describes where the tail of each oplog will begin, as name:timestamp pairs
+func (m *Mongodb) oplogPosition() string {
+	positions := make([]string, len(m.oplogs))
+	for i, o := range m.oplogs {
+		positions[i] = fmt.Sprintf("%s:%d", o.name, o.snapshot.end())
+	}
+	return strings.Join(positions, ",")
+}
+
+// discoverOplogs returns the oplogs that need to be tailed.  a replica set has a single oplog, which is read over the existing
+// session.  when connected to a mongos, the shards are discovered through the config servers and we connect to each shard's
+// replica set to read it's oplog.  the credentials in the uri are used for each shard.
+func (m *Mongodb) discoverOplogs() ([]*oplog, error) {
+	var isMaster struct {
+		Msg string `bson:"msg"`
+	}
+	if err := m.mongoSession.Run("isMaster", &isMaster); err != nil {
+		return nil, err
+	}
+
+	if isMaster.Msg != "isdbgrid" { // not a mongos
+		ts, err := lastOplogTimestamp(m.mongoSession)
+		return []*oplog{{name: "oplog", session: m.mongoSession, ts: ts}}, err
+	}
+
+	var shards []struct {
+		ID   string `bson:"_id"`
+		Host string `bson:"host"`
+	}
+	if err := m.mongoSession.DB("config").C("shards").Find(nil).All(&shards); err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards found")
+	}
+
+	info, err := mgo.ParseURL(m.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	oplogs := make([]*oplog, 0, len(shards))
+	for _, shard := range shards {
+		shardInfo := *info
+		shardInfo.ReplicaSetName, shardInfo.Addrs = splitShardHost(shard.Host)
+		shardInfo.Direct = false
+
+		session, err := mgo.DialWithInfo(&shardInfo)
+		if err == nil {
+			oplogs = append(oplogs, &oplog{name: shard.ID, session: session})
+			oplogs[len(oplogs)-1].ts, err = lastOplogTimestamp(session)
 		}
+		if err != nil {
+			for _, o := range oplogs {
+				o.session.Close()
+			}
+			return nil, fmt.Errorf("shard %s (%s)", shard.ID, err.Error())
+		}
+	}
+	return oplogs, nil
+}
 
+// closeOplogs closes the sessions we opened to each shard, a replica set's oplog is read over the adaptor's own session
+func (m *Mongodb) closeOplogs() {
+	for _, o := range m.oplogs {
+		if o.session != m.mongoSession {
+			o.session.Close()
+		}
+	}
+}
+
+// restoreCheckpoint sets the position of each oplog from the checkpoint.  restoreCheckpoint returns true only if
+// every oplog had a saved position, if any are missing we start over with a fresh copy
+func (m *Mongodb) restoreCheckpoint() (bool, error) {
+	positions := make([]bson.MongoTimestamp, len(m.oplogs))
+	for i, o := range m.oplogs {
+		ok, err := m.checkpoint.Get(o.name, &positions[i])
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+
+	for i, o := range m.oplogs {
+		o.ts = positions[i]
+	}
+	return true, nil
+}
+
+// mark sends a flush down the pipeline, and remembers the position of each oplog, so that they can be checkpointed
+// once every sink has processed the flush, and so everything before it
+func (m *Mongodb) mark() {
+	positions := make([]bson.MongoTimestamp, len(m.oplogs))
+	moved := false
+	for i, o := range m.oplogs {
+		positions[i] = o.sent
+		moved = moved || o.sent != o.marked
+		o.marked = o.sent
+	}
+	if !moved {
 		return
 	}
+
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	m.pipe.Send(flush)
+	m.marks = append(m.marks, mongoMark{receipt: flush.Receipt, positions: positions})
+}
+
+// confirmMarks checkpoints the latest positions that the sinks have caught up to
+func (m *Mongodb) confirmMarks(force bool) {
+	for len(m.marks) > 0 && m.marks[0].receipt.Delivered() {
+		for i, o := range m.oplogs {
+			o.delivered = m.marks[0].positions[i]
+		}
+		m.marks = m.marks[1:]
+	}
+	m.saveCheckpoint(force)
+}
+
+// saveCheckpoint records the position of each oplog
+func (m *Mongodb) saveCheckpoint(force bool) {
+	for _, o := range m.oplogs {
+		m.checkpoint.Set(o.name, o.delivered)
+	}
+	if err := m.checkpoint.Save(force); err != nil {
+		m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (can't save checkpoint %s)", err.Error()), nil)
+	}
 }
 
-/*
- * tail the oplog
- */
+// tailData tails each of the oplogs concurrently, and merges the operations into one stream.
+// every document lives on a single shard, and each shard's operations are sent in the order they happened,
+// so the order of operations on any one document is preserved
 func (m *Mongodb) tailData() (err error) {
+	var (
+		entries = make(chan oplogEntry)
+		errs    = make(chan error, len(m.oplogs))
+		done    = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	// don't save our starting position until the sinks have the copy, or a restart would skip it
+	if !waitForSinks(m.pipe) {
+		return nil
+	}
+
+	for _, o := range m.oplogs {
+		o.delivered, o.sent, o.marked = o.ts, o.ts, o.ts
+		wg.Add(1)
+		go func(o *oplog) {
+			defer wg.Done()
+			if err := m.tailOplog(o, entries, done); err != nil {
+				errs <- err
+			}
+		}(o)
+	}
+	go func() {
+		wg.Wait()
+		close(entries)
+	}()
 
+	// positions are only checkpointed once the sinks have processed everything before them
+	ticker := time.NewTicker(checkpointInterval)
+	m.saveCheckpoint(true)
+	defer func() {
+		ticker.Stop()
+		close(done)
+		m.confirmMarks(true)
+	}()
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return nil
+			}
+			if entry.msg != nil {
+				entry.msg.Meta = bson.M{"namespace": m.getNamespace(), "ts": int64(entry.ts)}
+				m.pipe.Send(entry.msg)
+			}
+			entry.oplog.sent = entry.ts
+		case <-ticker.C:
+			m.confirmMarks(false)
+			m.mark()
+		case err = <-errs:
+			return err
+		}
+	}
+}
+
+// tailOplog reads operations on our namespace from one oplog, and sends them on the entries channel
+func (m *Mongodb) tailOplog(o *oplog, entries chan<- oplogEntry, done <-chan struct{}) error {
 	var (
-		collection = m.mongoSession.DB("local").C("oplog.rs")
+		collection = o.session.DB("local").C("oplog.rs")
 		result     oplogDoc // hold the document
+		ts         = o.ts
 		query      = bson.M{
-			"ts": bson.M{"$gte": m.oplogTime},
-			"ns": m.getNamespace(),
+			"ts": bson.M{"$gt": ts},
+			"ns": bson.M{"$in": m.oplogNamespaces()},
 		}
 
 		iter = collection.Find(query).LogReplay().Sort("$natural").Tail(m.oplogTimeout)
@@ -189,30 +538,24 @@ func (m *Mongodb) tailData() (err error) {
 	for {
 		for iter.Next(&result) {
 			if stop := m.pipe.Stopped; stop {
-				return
+				return nil
 			}
-			if result.validOp() {
-				msg := message.NewMsg(message.OpTypeFromString(result.Op), nil)
-				msg.Timestamp = int64(result.Ts) >> 32
-
-				switch result.Op {
-				case "i":
-					msg.SetDocument(result.O)
-				case "d":
-					msg.SetDocument(result.O)
-				case "u":
-					doc, err := m.getOriginalDoc(result.O2)
-					if err != nil { // errors aren't fatal here, but we need to send it down the pipe
-						m.pipe.Err <- NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
-						continue
-					}
-					msg.SetDocument(doc)
-				default:
-					m.pipe.Err <- NewError(ERROR, m.path, "Mongodb error (unknown op type)", nil)
-					continue
+
+			entry := oplogEntry{oplog: o, ts: result.Ts}
+			// skip operations that the copy has already read
+			if result.validOp() && !o.snapshot.covers(result.Ts, result.id()) {
+				msg, err := m.oplogMessage(&result)
+				if err != nil { // errors aren't fatal here, but we need to send it down the pipe
+					m.pipe.Err <- err
 				}
-				m.oplogTime = result.Ts
-				m.pipe.Send(msg)
+				entry.msg = msg
+			}
+			ts = result.Ts
+
+			select {
+			case entries <- entry:
+			case <-done:
+				return nil
 			}
 			result = oplogDoc{}
 		}
@@ -220,39 +563,127 @@ func (m *Mongodb) tailData() (err error) {
 		// we've exited the mongo read loop, lets figure out why
 		// check here again if we've been asked to quit
 		if stop := m.pipe.Stopped; stop {
-			return
+			return nil
 		}
 		if iter.Timeout() {
 			continue
 		}
 		if iter.Err() != nil {
-			return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading collection %s)", iter.Err()), nil)
+			return NewError(CRITICAL, m.path, fmt.Sprintf("Mongodb error (error reading %s %s)", o.name, iter.Err()), nil)
 		}
 
 		// query will change,
 		query = bson.M{
-			"ts": bson.M{"$gte": m.oplogTime},
-			"ns": m.getNamespace(),
+			"ts": bson.M{"$gt": ts},
+			"ns": bson.M{"$in": m.oplogNamespaces()},
 		}
 		iter = collection.Find(query).LogReplay().Tail(m.oplogTimeout)
 	}
 }
 
+// oplogMessage turns an oplog entry into a message.  a nil message is returned if the document doesn't match the query
+func (m *Mongodb) oplogMessage(result *oplogDoc) (*message.Msg, error) {
+	msg := message.NewMsg(message.OpTypeFromString(result.Op), nil)
+	msg.Timestamp = int64(result.Ts) >> 32
+
+	switch result.Op {
+	case "i":
+		if !m.filtered() {
+			msg.SetDocument(result.O)
+			break
+		}
+		doc, err := m.getOriginalDoc(result.O)
+		if err == mgo.ErrNotFound { // doesn't match the query, skip it
+			return nil, nil
+		} else if err != nil {
+			return nil, NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
+		}
+		msg.SetDocument(doc)
+	case "d":
+		msg.SetDocument(result.O)
+	case "u":
+		doc, err := m.getOriginalDoc(result.O2)
+		if err == mgo.ErrNotFound && m.filtered() {
+			// the document no longer matches the query, so it needs to be removed from the sinks
+			msg.Op = message.Delete
+			msg.SetDocument(bson.M{"_id": result.O2["_id"]})
+			break
+		} else if err != nil {
+			return nil, NewError(ERROR, m.path, fmt.Sprintf("Mongodb error (%s)", err.Error()), nil)
+		}
+		msg.SetDocument(doc)
+	case "c":
+		return m.commandMessage(result), nil
+	default:
+		return nil, NewError(ERROR, m.path, "Mongodb error (unknown op type)", nil)
+	}
+	return msg, nil
+}
+
+// commandMessage turns a command from the oplog into a Command message.  drop, dropDatabase, create and renameCollection
+// are passed along if they affect our collection, every other command is skipped and nil is returned
+func (m *Mongodb) commandMessage(result *oplogDoc) (msg *message.Msg) {
+	inDatabase := result.Ns == m.database+".$cmd"
+
+	switch {
+	case inDatabase && result.O["drop"] == m.collection:
+		msg = message.NewCommandMsg(message.Drop, nil)
+	case inDatabase && result.O["dropDatabase"] != nil:
+		msg = message.NewCommandMsg(message.Drop, nil)
+	case inDatabase && result.O["create"] == m.collection:
+		msg = message.NewCommandMsg(message.Create, nil)
+	case result.O["renameCollection"] == m.getNamespace():
+		msg = message.NewCommandMsg(message.Rename, result.O["to"])
+	default:
+		return nil
+	}
+
+	msg.Timestamp = int64(result.Ts) >> 32
+	return msg
+}
+
+// oplogNamespaces are the namespaces we read from the oplog, our collection's and the namespaces
+// that commands against it are logged to
+func (m *Mongodb) oplogNamespaces() []string {
+	return []string{m.getNamespace(), m.database + ".$cmd", "admin.$cmd"}
+}
+
 // getOriginalDoc retrieves the original document from the database.  transport has no knowledge of update operations, all updates
-// work as wholesale document replaces
+// work as wholesale document replaces.
+// if a query has been configured, the document is only returned if it still matches the query, otherwise mgo.ErrNotFound
+// is returned unaltered so the caller can tell the difference between a filtered document and a failure
 func (m *Mongodb) getOriginalDoc(doc bson.M) (result bson.M, err error) {
 	id, exists := doc["_id"]
 	if !exists {
 		return result, fmt.Errorf("Can't get _id from document")
 	}
 
-	err = m.mongoSession.DB(m.database).C(m.collection).FindId(id).One(&result)
-	if err != nil {
+	query := bson.M{"_id": id}
+	if len(m.query) > 0 {
+		query = bson.M{"$and": []bson.M{m.query, query}}
+	}
+
+	err = m.mongoSession.DB(m.database).C(m.collection).Find(query).Select(m.projection).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
 		err = fmt.Errorf("%s %v %v", m.getNamespace(), id, err)
 	}
 	return
 }
 
+// copyQuery returns the query used to copy the collection, an empty query will match every document
+func (m *Mongodb) copyQuery() bson.M {
+	if m.query == nil {
+		return bson.M{}
+	}
+	return m.query
+}
+
+// filtered reports whether a query or projection has been configured.  filtered adaptors need to
+// read tailed documents back from the collection rather than trusting the oplog entry
+func (m *Mongodb) filtered() bool {
+	return len(m.query) > 0 || len(m.projection) > 0
+}
+
 func (m *Mongodb) getNamespace() string {
 	return strings.Join([]string{m.database, m.collection}, ".")
 }
@@ -267,6 +698,48 @@ func (m *Mongodb) splitNamespace(namespace string) (string, string, error) {
 	return fields[0], fields[1], nil
 }
 
+// lastOplogTimestamp returns the timestamp of the newest entry in the session's oplog
+func lastOplogTimestamp(session *mgo.Session) (bson.MongoTimestamp, error) {
+	var result oplogDoc
+	err := session.DB("local").C("oplog.rs").Find(nil).Sort("-$natural").One(&result)
+	return result.Ts, err
+}
+
+// splitShardHost splits the host of a shard, as stored in config.shards, into the replica set name and
+// a list of addresses.  eg. "rs0/host1:27017,host2:27017"
+func splitShardHost(host string) (string, []string) {
+	var replicaSet string
+	if i := strings.Index(host, "/"); i >= 0 {
+		replicaSet, host = host[:i], host[i+1:]
+	}
+	return replicaSet, strings.Split(host, ",")
+}
+
+// oplog is one oplog that the adaptor is tailing.  a replica set has only one, and a sharded cluster has one for each shard
+type oplog struct {
+	name     string
+	session  *mgo.Session
+	snapshot *snapshot // tracks the progress of the copy so that the tail can skip operations the copy already reflects
+
+	ts        bson.MongoTimestamp // where the tail starts
+	sent      bson.MongoTimestamp // the last operation that was sent down the pipe
+	marked    bson.MongoTimestamp // the position of the last mark
+	delivered bson.MongoTimestamp // the last operation that every sink has processed
+}
+
+// mongoMark is the position of each oplog, and the receipt of a flush that was sent after everything before them
+type mongoMark struct {
+	receipt   *message.Receipt
+	positions []bson.MongoTimestamp
+}
+
+// oplogEntry is an operation read from an oplog.  msg is nil if the operation doesn't need to be sent
+type oplogEntry struct {
+	oplog *oplog
+	ts    bson.MongoTimestamp
+	msg   *message.Msg
+}
+
 // oplogDoc are representations of the mongodb oplog document
 // detailed here, among other places.  http://www.kchodorow.com/blog/2010/10/12/replication-internals/
 type oplogDoc struct {
@@ -277,22 +750,299 @@ type oplogDoc struct {
 	Ns string              `bson:"ns"`
 	O  bson.M              `bson:"o"`
 	O2 bson.M              `bson:"o2"`
+
+	FromMigrate bool `bson:"fromMigrate"` // set on operations caused by moving chunks between shards
+}
+
+// id returns the _id of the document this operation was applied to
+func (o *oplogDoc) id() interface{} {
+	if o.Op == "u" {
+		return o.O2["_id"]
+	}
+	return o.O["_id"]
 }
 
-// validOp checks to see if we're an insert, delete, or update, otherwise the
+// validOp checks to see if we're an insert, delete, update or command, otherwise the
 // document is skilled.
 // TODO: skip system collections
 func (o *oplogDoc) validOp() bool {
-	return o.Op == "i" || o.Op == "d" || o.Op == "u"
+	if o.FromMigrate { // the document is only changing shards
+		return false
+	}
+	return o.Op == "i" || o.Op == "d" || o.Op == "u" || o.Op == "c"
 }
 
 // MongodbConfig provides configuration options for a mongodb adaptor
-// the notable difference between this and dbConfig is the presence of the Tail option
+// the notable difference between this and dbConfig is the presence of the Tail option.
+// the uri can point to either a replica set or a mongos, when pointed to a mongos the oplog of each shard is tailed
 type MongodbConfig struct {
 	URI       string `json:"uri"`
 	Namespace string `json:"namespace"`
 	Debug     bool   `json:"debug"`
 	Tail      bool   `json:"tail"`
+
+	// Query and Projection restrict the documents, and the fields of those documents, that are
+	// copied and tailed.  they can be given either as a hash, or as a string of (extended) json, eg.
+	//   Source({name: "localmongo", namespace: "boom.users", query: {active: true}, projection: {password: 0}})
+	Query      interface{} `json:"query"`
+	Projection interface{} `json:"projection"`
+
+	// Checkpoint is a file where the position in the oplog is saved while tailing.  on restart, if a checkpoint has been saved,
+	// the copy is skipped and the tail picks up where it left off.  sharded clusters save a position for each shard
+	Checkpoint string `json:"checkpoint"`
+
+	// Commands sets what a sink does with drop, create and rename commands from the source, either "apply", "warn" or "ignore".
+	// the default is to warn
+	Commands string `json:"commands"`
+}
+
+// parseMongoDocument turns a query or projection from the config into a bson.M.
+// strings are parsed as json, and mongo extended json (ie. {"$oid": ...}, {"$date": ...}) is converted
+// into the proper bson types
+func parseMongoDocument(raw interface{}) (bson.M, error) {
+	switch r := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if strings.TrimSpace(r) == "" {
+			return nil, nil
+		}
+		return extjson.Unmarshal([]byte(r))
+	case map[string]interface{}:
+		doc, err := extjson.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		return doc.(bson.M), nil
+	default:
+		return nil, fmt.Errorf("expected a hash or a json string, got %T", raw)
+	}
+}
+
+// copyCursor pages through a collection in _id order.  a range query on _id only matches ids of the same bson type as
+// the bound, so each type, or group of types that compare as one, ie. numbers, is read in turn, and once it's been read,
+// it's excluded from the queries for the ones after it
+type copyCursor struct {
+	after interface{} // the last _id read from the current type
+	done  []string    // the types that have been read, as $type aliases
+}
+
+// query is the query for the next page
+func (c *copyCursor) query(base bson.M) bson.M {
+	conds := []bson.M{base}
+	for _, alias := range c.done {
+		conds = append(conds, bson.M{"_id": bson.M{"$not": bson.M{"$type": alias}}})
+	}
+	if c.after != nil {
+		conds = append(conds, bson.M{"_id": bson.M{"$gt": c.after}})
+	}
+	if len(conds) == 1 {
+		return base
+	}
+	return bson.M{"$and": conds}
+}
+
+// next moves the cursor past a page of at most limit documents, and reports whether there may be more to read.
+// a page that starts a new type can run on into the types after it, it's cut short at the end of the first type,
+// and the rest is read again once the cursor gets to it
+func (c *copyCursor) next(page []bson.M, limit int) ([]bson.M, bool, error) {
+	if len(page) == 0 {
+		if c.after == nil {
+			return nil, false, nil // there are no types left
+		}
+		return nil, true, c.finish(c.after)
+	}
+
+	first, ok := bsonTypeAliases(page[0]["_id"])
+	if !ok {
+		return nil, false, fmt.Errorf("can't copy past an _id of type %T", page[0]["_id"])
+	}
+	for i, doc := range page[1:] {
+		if aliases, _ := bsonTypeAliases(doc["_id"]); len(aliases) == 0 || aliases[0] != first[0] {
+			page = page[:i+1]
+			return page, true, c.finish(page[i]["_id"])
+		}
+	}
+	if len(page) < limit {
+		return page, true, c.finish(page[len(page)-1]["_id"])
+	}
+	c.after = page[len(page)-1]["_id"]
+	return page, true, nil
+}
+
+// finish moves the cursor on past the type of id
+func (c *copyCursor) finish(id interface{}) error {
+	aliases, ok := bsonTypeAliases(id)
+	if !ok {
+		return fmt.Errorf("can't copy past an _id of type %T", id)
+	}
+	c.done, c.after = append(c.done, aliases...), nil
+	return nil
+}
+
+// bsonTypeAliases returns the $type aliases of the types that compare as the same type as v
+func bsonTypeAliases(v interface{}) ([]string, bool) {
+	switch v.(type) {
+	case nil:
+		return []string{"null"}, true
+	case int, int32, int64, float64, bson.Decimal128:
+		return []string{"number"}, true
+	case string, bson.Symbol:
+		return []string{"string", "symbol"}, true
+	case bson.M, bson.D, map[string]interface{}:
+		return []string{"object"}, true
+	case []interface{}:
+		return []string{"array"}, true
+	case []byte, bson.Binary:
+		return []string{"binData"}, true
+	case bson.ObjectId:
+		return []string{"objectId"}, true
+	case bool:
+		return []string{"bool"}, true
+	case time.Time:
+		return []string{"date"}, true
+	case bson.MongoTimestamp:
+		return []string{"timestamp"}, true
+	case bson.RegEx:
+		return []string{"regex"}, true
+	}
+	switch v {
+	case bson.MinKey:
+		return []string{"minKey"}, true
+	case bson.MaxKey:
+		return []string{"maxKey"}, true
+	}
+	return nil, false
+}
+
+// snapshotMarkInterval is how often, in documents, the copy records its progress against the oplog
+const snapshotMarkInterval = 1000
+
+// snapshot keeps track of the progress of a copy relative to the oplog.
+// the collection is copied in _id order, so at any point in time every document with an _id greater than the
+// last one read is yet to be copied.  an operation in the oplog against one of those documents will already be reflected
+// when the copy reaches it, and doesn't need to be sent again when tailing.
+// progress is recorded periodically as marks, pairing a position in the oplog with the last _id that had been fetched from
+// the server by then, which may be ahead of the last document sent down the pipeline
+type snapshot struct {
+	marks []snapshotMark
+}
+
+type snapshotMark struct {
+	ts     bson.MongoTimestamp
+	lastID interface{} // nil if nothing had been read yet
+}
+
+// newSnapshot creates a snapshot starting at the given oplog position
+func newSnapshot(ts bson.MongoTimestamp) *snapshot {
+	return &snapshot{marks: []snapshotMark{{ts: ts}}}
+}
+
+// mark records that by the time the oplog had reached ts, the copy had read up to lastID
+func (s *snapshot) mark(ts bson.MongoTimestamp, lastID interface{}) {
+	s.marks = append(s.marks, snapshotMark{ts: ts, lastID: lastID})
+}
+
+// end returns the oplog position of the last mark, ie. where the copy finished
+func (s *snapshot) end() bson.MongoTimestamp {
+	return s.marks[len(s.marks)-1].ts
+}
+
+// covers reports whether an operation against the given id at ts is already reflected in the copy.
+// we look at the first mark at or after ts; the copy had read no further than that mark's lastID when the operation happened,
+// so if id sorts after it, the copy read the document afterwards.  ids that can't be compared are never covered,
+// we'd rather send a document twice than not at all
+func (s *snapshot) covers(ts bson.MongoTimestamp, id interface{}) bool {
+	if s == nil || id == nil {
+		return false
+	}
+	for _, mark := range s.marks {
+		if mark.ts < ts {
+			continue
+		}
+		if mark.lastID == nil {
+			return true
+		}
+		cmp, ok := compareIDs(id, mark.lastID)
+		return ok && cmp > 0
+	}
+	return false
+}
+
+// compareIDs compares two _id values of the same bson type, returning -1, 0 or 1.
+// the second return value is false if the values can't be compared
+func compareIDs(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case bson.ObjectId:
+		if bv, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(av), string(bv)), true
+		}
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case time.Time:
+		if bv, ok := b.(time.Time); ok {
+			switch {
+			case av.Before(bv):
+				return -1, true
+			case av.After(bv):
+				return 1, true
+			}
+			return 0, true
+		}
+	default:
+		// integers are compared as integers, ids beyond 2^53 aren't exact as floats
+		ai, aok := toInt(a)
+		bi, bok := toInt(b)
+		if aok && bok {
+			switch {
+			case ai < bi:
+				return -1, true
+			case ai > bi:
+				return 1, true
+			}
+			return 0, true
+		}
+		af, aok := toFloat(a)
+		bf, bok := toFloat(b)
+		if aok && bok {
+			switch {
+			case af < bf:
+				return -1, true
+			case af > bf:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
 }
 
 func nowAsMongoTimestamp() bson.MongoTimestamp {
@@ -0,0 +1,252 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseMongoDocument(t *testing.T) {
+	data := []struct {
+		in  interface{}
+		out bson.M
+		err bool
+	}{
+		{nil, nil, false},
+		{"", nil, false},
+		{`{"active": true}`, bson.M{"active": true}, false},
+		{map[string]interface{}{"password": float64(0)}, bson.M{"password": 0}, false},
+		{`{"_id": {"$oid": "546656989330a846dc7ce327"}}`, bson.M{"_id": bson.ObjectIdHex("546656989330a846dc7ce327")}, false},
+		{`{"active": `, nil, true},
+		{[]interface{}{"active"}, nil, true},
+	}
+
+	for _, v := range data {
+		out, err := parseMongoDocument(v.in)
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error: %t, got: %v", v.in, v.err, err)
+			continue
+		}
+		if !v.err && !reflect.DeepEqual(out, v.out) {
+			t.Errorf("%v: expected: %v, got: %v", v.in, v.out, out)
+		}
+	}
+}
+
+func TestSnapshotCovers(t *testing.T) {
+	s := newSnapshot(newMongoTimestamp(100, 0))
+	s.mark(newMongoTimestamp(110, 0), 10)
+	s.mark(newMongoTimestamp(120, 0), 20)
+
+	data := []struct {
+		ts  bson.MongoTimestamp
+		id  interface{}
+		out bool
+	}{
+		{newMongoTimestamp(100, 0), 1, true},   // nothing had been copied yet
+		{newMongoTimestamp(105, 0), 5, false},  // the copy may have already read 5
+		{newMongoTimestamp(105, 0), 11, true},  // the copy hadn't reached 11
+		{newMongoTimestamp(115, 0), 20, false}, // the copy may have already read 20
+		{newMongoTimestamp(115, 0), 21, true},
+		{newMongoTimestamp(125, 0), 50, false}, // after the copy finished
+		{newMongoTimestamp(105, 0), "11", false},
+		{newMongoTimestamp(105, 0), nil, false},
+	}
+
+	for _, v := range data {
+		if out := s.covers(v.ts, v.id); out != v.out {
+			t.Errorf("%d %v: expected %t, got %t", v.ts>>32, v.id, v.out, out)
+		}
+	}
+}
+
+func TestCompareIDs(t *testing.T) {
+	data := []struct {
+		a, b interface{}
+		cmp  int
+		ok   bool
+	}{
+		{int64(1) << 60, int64(1)<<60 + 1, -1, true}, // the same float64
+		{int64(1)<<60 + 1, int64(1) << 60, 1, true},
+		{int32(5), int64(5), 0, true},
+		{5, 4.5, 1, true},
+		{bson.ObjectIdHex("546656989330a846dc7ce327"), bson.ObjectIdHex("546656989330a846dc7ce328"), -1, true},
+		{"b", "a", 1, true},
+		{"1", 1, 0, false},
+	}
+
+	for _, v := range data {
+		if cmp, ok := compareIDs(v.a, v.b); cmp != v.cmp || ok != v.ok {
+			t.Errorf("%v %v: expected %d %t, got %d %t", v.a, v.b, v.cmp, v.ok, cmp, ok)
+		}
+	}
+}
+
+func TestCopyCursor(t *testing.T) {
+	// a collection with mixed _id types, in the order mongodb sorts them
+	ids := []interface{}{1, 2.5, int64(3), 4, "a", "b", bson.ObjectIdHex("546656989330a846dc7ce327"), true}
+
+	// find runs a query the way mongodb would, a $gt only matches ids of the same type
+	find := func(query bson.M, limit int) (page []bson.M) {
+		conds, _ := query["$and"].([]bson.M)
+		for _, id := range ids {
+			aliases, _ := bsonTypeAliases(id)
+			match := true
+			for _, cond := range conds {
+				c, ok := cond["_id"].(bson.M)
+				if !ok {
+					continue
+				}
+				if not, ok := c["$not"].(bson.M); ok && not["$type"] == aliases[0] {
+					match = false
+				}
+				if gt, ok := c["$gt"]; ok {
+					if cmp, ok := compareIDs(id, gt); !ok || cmp <= 0 {
+						match = false
+					}
+				}
+			}
+			if match && len(page) < limit {
+				page = append(page, bson.M{"_id": id})
+			}
+		}
+		return page
+	}
+
+	var (
+		cursor = &copyCursor{}
+		read   []interface{}
+	)
+	for i := 0; i < 20; i++ {
+		page, more, err := cursor.next(find(cursor.query(bson.M{}), 3), 3)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, doc := range page {
+			read = append(read, doc["_id"])
+		}
+		if !more {
+			break
+		}
+	}
+	if !reflect.DeepEqual(read, ids) {
+		t.Errorf("expected every id to be read once, in order, got %v", read)
+	}
+
+	if _, _, err := (&copyCursor{}).next([]bson.M{{"_id": struct{}{}}}, 3); err == nil {
+		t.Errorf("expected an error for an _id of an unknown type")
+	}
+}
+
+func TestMongoMarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "checkpoint.json")
+	c, err := newCheckpoint(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "sink")
+	o := &oplog{name: "shard0"}
+	m := &Mongodb{pipe: source, path: "a/b/c", checkpoint: c, oplogs: []*oplog{o}}
+
+	saved := func() (position bson.MongoTimestamp) {
+		c, err := newCheckpoint(filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.Get("shard0", &position)
+		return position
+	}
+
+	flushes := make(chan *message.Msg, 1)
+	go func() {
+		flushes <- <-sink.In
+	}()
+	o.sent = newMongoTimestamp(100, 1)
+	m.mark()
+	flush := <-flushes
+	if !flush.IsCommand(message.Flush) || flush.Receipt == nil {
+		t.Fatalf("expected a flush with a receipt, got %v", flush)
+	}
+	m.mark() // nothing's been sent since
+	if len(m.marks) != 1 {
+		t.Errorf("expected 1 mark, got %d", len(m.marks))
+	}
+
+	m.confirmMarks(true)
+	if position := saved(); position != 0 {
+		t.Errorf("expected nothing to be checkpointed before the sinks have the flush, got %d", position>>32)
+	}
+	flush.Receipt.Processed()
+	m.confirmMarks(true)
+	if position := saved(); position != newMongoTimestamp(100, 1) {
+		t.Errorf("expected 100, got %d", position>>32)
+	}
+	if len(m.marks) != 0 {
+		t.Errorf("expected the mark to have been confirmed, got %d", len(m.marks))
+	}
+}
+
+func TestSplitShardHost(t *testing.T) {
+	data := []struct {
+		in         string
+		replicaSet string
+		addrs      []string
+	}{
+		{"rs0/host1:27017,host2:27018", "rs0", []string{"host1:27017", "host2:27018"}},
+		{"host1:27017", "", []string{"host1:27017"}},
+	}
+
+	for _, v := range data {
+		replicaSet, addrs := splitShardHost(v.in)
+		if replicaSet != v.replicaSet || !reflect.DeepEqual(addrs, v.addrs) {
+			t.Errorf("%s: expected %s %v, got %s %v", v.in, v.replicaSet, v.addrs, replicaSet, addrs)
+		}
+	}
+}
+
+func TestCommandMessage(t *testing.T) {
+	m := &Mongodb{database: "boom", collection: "foo"}
+
+	data := []struct {
+		in  oplogDoc
+		c   message.CommandType
+		arg interface{}
+		ok  bool
+	}{
+		{oplogDoc{Op: "c", Ns: "boom.$cmd", O: bson.M{"drop": "foo"}}, message.Drop, true, true},
+		{oplogDoc{Op: "c", Ns: "boom.$cmd", O: bson.M{"drop": "bar"}}, 0, nil, false},
+		{oplogDoc{Op: "c", Ns: "boom.$cmd", O: bson.M{"dropDatabase": 1}}, message.Drop, true, true},
+		{oplogDoc{Op: "c", Ns: "other.$cmd", O: bson.M{"dropDatabase": 1}}, 0, nil, false},
+		{oplogDoc{Op: "c", Ns: "boom.$cmd", O: bson.M{"create": "foo"}}, message.Create, true, true},
+		{oplogDoc{Op: "c", Ns: "admin.$cmd", O: bson.M{"renameCollection": "boom.foo", "to": "boom.baz"}}, message.Rename, "boom.baz", true},
+		{oplogDoc{Op: "c", Ns: "admin.$cmd", O: bson.M{"renameCollection": "boom.baz", "to": "boom.foo"}}, 0, nil, false},
+		{oplogDoc{Op: "c", Ns: "boom.$cmd", O: bson.M{"collMod": "foo"}}, 0, nil, false},
+	}
+
+	for _, v := range data {
+		msg := m.commandMessage(&v.in)
+		if (msg != nil) != v.ok {
+			t.Errorf("%v: expected a message: %t, got %v", v.in.O, v.ok, msg)
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+		if c, arg, _ := msg.Command(); c != v.c || arg != v.arg {
+			t.Errorf("%v: expected %s %v, got %s %v", v.in.O, v.c, v.arg, c, arg)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package adaptor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/compose/transporter/pkg/message"
+)
+
+// Listen starts the listener.  the table's columns are read when we start, and each document's fields are written to the
+// columns of the same name, with the document id in the primary key.  fields without a column are left out, and hashes
+// and arrays are stored as json
+func (m *Mysql) Listen() (err error) {
+	err = m.connect()
+	if err == nil {
+		err = m.describeTable(m.target)
+	}
+	if err != nil {
+		m.pipe.Err <- NewError(CRITICAL, m.path, fmt.Sprintf("Mysql error (%s)", err.Error()), nil)
+		return err
+	}
+	defer m.db.Close()
+
+	return m.batch.Listen(m.pipe, m.db)
+}
+
+// statement builds the sql for a message.  inserts and updates are upserts, a partial update only changes the columns
+// that are in the document, otherwise columns that aren't in the document are set to null
+func (m *Mysql) statement(msg *message.Msg) (string, []interface{}, error) {
+	var (
+		table = m.target.quotedName()
+		key   = mysqlQuote(m.target.key)
+		id    = sqlValue(msg.ID)
+	)
+	if msg.Op == message.Delete {
+		return fmt.Sprintf("DELETE FROM %s WHERE %s = ?", table, key), []interface{}{id}, nil
+	}
+
+	var (
+		columns = []string{key}
+		args    = []interface{}{id}
+		updates []string
+		doc     = msg.Document()
+	)
+	for _, c := range m.target.columns {
+		if c.name == m.target.key {
+			continue
+		}
+		v, ok := doc[c.name]
+		if !ok && msg.Partial {
+			continue
+		}
+		v, err := sqlColumnValue(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("can't convert %s (%s)", c.name, err.Error())
+		}
+		column := mysqlQuote(c.name)
+		columns = append(columns, column)
+		args = append(args, v)
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", column, column))
+	}
+	if len(updates) == 0 { // nothing to update, but the row should still be there
+		updates = append(updates, fmt.Sprintf("%s = %s", key, key))
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s", table, strings.Join(columns, ", "), placeholders, strings.Join(updates, ", "))
+	return query, args, nil
+}
+
+// runCommand applies drop and rename commands to the table, according to the commands option.
+// a table can't be created without knowing it's columns, so create commands are only warned about
+func (m *Mysql) runCommand(msg *message.Msg) error {
+	c, arg, ok := msg.Command()
+	if !ok || c == message.Flush || c == message.CopyComplete { // the batch has already been written
+		return nil
+	}
+
+	switch {
+	case m.commands == commandsIgnore:
+		return nil
+	case m.commands == commandsWarn, c == message.Create:
+		m.pipe.Err <- commandWarning(m.path, c, arg)
+		return nil
+	}
+
+	var err error
+	switch c {
+	case message.Drop:
+		_, err = m.db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", m.target.quotedName()))
+	case message.Rename:
+		to, ok := arg.(string)
+		if !ok {
+			return fmt.Errorf("malformed rename (%v)", arg)
+		}
+		fields := strings.SplitN(to, ".", 2)
+		table := fields[len(fields)-1]
+		_, err = m.db.Exec(fmt.Sprintf("RENAME TABLE %s TO %s", m.target.quotedName(), mysqlQuote(m.target.schema)+"."+mysqlQuote(table)))
+		if err == nil {
+			m.target.name = table
+		}
+	}
+	return err
+}
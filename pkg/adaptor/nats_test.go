@@ -0,0 +1,118 @@
+package adaptor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// runNatsServer starts an embedded nats server with jetstream, and a stream capturing blog.>
+func runNatsServer(t *testing.T) *server.Server {
+	s, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go s.Start()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("nats server didn't start")
+	}
+	t.Cleanup(s.Shutdown)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer nc.Close()
+	js, _ := nc.JetStream()
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "BLOG", Subjects: []string{"blog.>"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s
+}
+
+func TestNatsRoundTrip(t *testing.T) {
+	s := runNatsServer(t)
+
+	a, err := NewNats(pipe.NewPipe(nil, "some name"), "a/b/c", Config{"uri": s.ClientURL(), "namespace": "blog.posts", "jetstream": true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sink := a.(*Nats)
+	if err := sink.connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer sink.conn.Close()
+
+	update := message.NewMsg(message.Update, bson.M{"_id": "b", "title": "edited"})
+	update.Partial = true
+	update.Meta = bson.M{"namespace": "blog.drafts"}
+	in := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": "a", "title": "hello", "views": int64(10)}),
+		update,
+		message.NewMsg(message.Delete, bson.M{"_id": "a"}),
+	}
+	subjects := []string{"blog.posts.insert", "blog.drafts.update", "blog.posts.delete"}
+	for _, msg := range in {
+		sink.applyOp(msg)
+	}
+	sink.applyOp(message.NewCommandMsg(message.Flush, nil))
+	if info, err := sink.js.StreamInfo("BLOG"); err != nil || info.State.Msgs != 3 {
+		t.Fatalf("expected 3 messages in the stream, got %+v (%v)", info, err)
+	}
+
+	// read them back, through a pipeline
+	var (
+		source = pipe.NewPipe(nil, "source")
+		out    = pipe.NewPipe(source, "sink")
+		msgs   = make(chan *message.Msg, 10)
+	)
+	go func() {
+		for range source.Err {
+		}
+	}()
+	go out.Listen(func(msg *message.Msg) (*message.Msg, error) {
+		if msg.Op != message.Command {
+			msgs <- msg
+		}
+		return msg, nil
+	})
+	a, err = NewNats(source, "a/b/c", Config{"uri": s.ClientURL(), "stream": "BLOG", "durable": "test"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go a.Start()
+	defer a.Stop()
+
+	for i, v := range in {
+		select {
+		case msg := <-msgs:
+			if msg.Op != v.Op || msg.ID != v.ID || msg.Partial != v.Partial || !reflect.DeepEqual(msg.Document(), v.Document()) {
+				t.Errorf("%d: expected %s %v, got %s %v", i, v.Op, v.Document(), msg.Op, msg.Document())
+			}
+			if msg.Meta["subject"] != subjects[i] || msg.Meta["seq"] != int64(i+1) {
+				t.Errorf("%d: unexpected meta %v", i, msg.Meta)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d: timed out waiting for the message", i)
+		}
+	}
+
+	// the messages are acked once the sink has them
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, err := sink.js.ConsumerInfo("BLOG", "test")
+		if err == nil && info.AckFloor.Stream == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the messages to be acked, got %+v (%v)", info, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,457 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// postgresDecoder decodes the rows read from a replication slot into changes to our tables
+type postgresDecoder interface {
+	// decode returns the changes in data, which was read from the slot at lsn.  if data ends a transaction, decode also
+	// returns the position of the end of the transaction.  transactions that ended before confirmed are skipped
+	decode(lsn uint64, data []byte, confirmed uint64) ([]*postgresChange, uint64, error)
+}
+
+// wal2jsonDecoder decodes wal2json's output, where each transaction is a json object with a list of changes
+type wal2jsonDecoder struct {
+	tables map[string]*postgresTable
+}
+
+type wal2jsonChange struct {
+	Kind         string        `json:"kind"`
+	Schema       string        `json:"schema"`
+	Table        string        `json:"table"`
+	ColumnNames  []string      `json:"columnnames"`
+	ColumnTypes  []string      `json:"columntypes"`
+	ColumnValues []interface{} `json:"columnvalues"`
+	OldKeys      struct {
+		KeyNames  []string      `json:"keynames"`
+		KeyTypes  []string      `json:"keytypes"`
+		KeyValues []interface{} `json:"keyvalues"`
+	} `json:"oldkeys"`
+}
+
+func newWal2jsonDecoder(tables []*postgresTable) *wal2jsonDecoder {
+	return &wal2jsonDecoder{tables: postgresTablesByNamespace(tables)}
+}
+
+func (d *wal2jsonDecoder) decode(lsn uint64, data []byte, confirmed uint64) ([]*postgresChange, uint64, error) {
+	// the whole transaction is written when it commits, so lsn is the end of the transaction
+	if lsn <= confirmed {
+		return nil, lsn, nil
+	}
+
+	var tx struct {
+		Change []wal2jsonChange `json:"change"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&tx); err != nil {
+		return nil, lsn, err
+	}
+
+	var (
+		changes []*postgresChange
+		lastErr error
+	)
+	for _, c := range tx.Change {
+		t, ok := d.tables[c.Schema+"."+c.Table]
+		if !ok {
+			continue
+		}
+
+		change := &postgresChange{table: t}
+		switch c.Kind {
+		case "insert":
+			change.op = message.Insert
+		case "update":
+			change.op = message.Update
+		case "delete":
+			change.op = message.Delete
+		default:
+			continue
+		}
+
+		old, err := postgresDocument(c.OldKeys.KeyNames, c.OldKeys.KeyTypes, c.OldKeys.KeyValues)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if change.op == message.Delete {
+			change.doc = old
+		} else {
+			if change.doc, err = postgresDocument(c.ColumnNames, c.ColumnTypes, c.ColumnValues); err != nil {
+				lastErr = err
+				continue
+			}
+			if len(old) > 0 {
+				change.old = old
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, lsn, lastErr
+}
+
+// postgresDocument builds a document from lists of columns, their types and values
+func postgresDocument(names, types []string, values []interface{}) (bson.M, error) {
+	if len(names) != len(types) || len(names) != len(values) {
+		return nil, fmt.Errorf("mismatched columns")
+	}
+	doc := make(bson.M, len(names))
+	for i, name := range names {
+		v, err := postgresConvert(types[i], values[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s (%s)", name, err.Error())
+		}
+		doc[name] = v
+	}
+	return doc, nil
+}
+
+// pgoutputDecoder decodes the binary messages of the pgoutput plugin.  each row from the slot is one message, the changes
+// to a table come after a relation message that describes the table, and a transaction is wrapped in begin and commit messages
+type pgoutputDecoder struct {
+	tables    map[string]*postgresTable
+	relations map[uint32]*pgoutputRelation
+	skip      bool // the transaction we're reading has already been delivered
+}
+
+type pgoutputRelation struct {
+	table   *postgresTable // nil if the relation isn't one of our tables
+	columns []string
+}
+
+func newPgoutputDecoder(tables []*postgresTable) *pgoutputDecoder {
+	return &pgoutputDecoder{
+		tables:    postgresTablesByNamespace(tables),
+		relations: make(map[uint32]*pgoutputRelation),
+	}
+}
+
+func (d *pgoutputDecoder) decode(lsn uint64, data []byte, confirmed uint64) (changes []*postgresChange, commit uint64, err error) {
+	r := &pgoutputReader{data: data}
+
+	switch kind := r.byte(); kind {
+	case 'B':
+		// the begin message has the position of the commit, which comes before the end of the transaction
+		d.skip = r.uint64() < confirmed
+	case 'C':
+		r.byte() // flags
+		r.uint64()
+		commit = r.uint64()
+		d.skip = false
+	case 'R':
+		id := r.uint32()
+		namespace := r.string() + "." + r.string()
+		r.byte() // replica identity
+		rel := &pgoutputRelation{table: d.tables[namespace], columns: make([]string, r.uint16())}
+		for i := range rel.columns {
+			r.byte() // flags
+			rel.columns[i] = r.string()
+			r.uint32() // type
+			r.uint32() // type modifier
+		}
+		d.relations[id] = rel
+	case 'I', 'U', 'D':
+		if d.skip {
+			return nil, 0, nil
+		}
+		rel, ok := d.relations[r.uint32()]
+		if !ok {
+			return nil, 0, fmt.Errorf("change to an unknown relation")
+		}
+		if rel.table == nil {
+			return nil, 0, nil
+		}
+
+		change := &postgresChange{table: rel.table}
+		switch kind {
+		case 'I':
+			change.op = message.Insert
+			r.byte() // N
+			change.doc, change.partial, err = d.tuple(r, rel, true)
+		case 'U':
+			change.op = message.Update
+			if t := r.byte(); t == 'K' || t == 'O' { // the old row, if the key changed or the table has a full replica identity
+				if change.old, _, err = d.tuple(r, rel, t == 'O'); err != nil {
+					return nil, 0, err
+				}
+				r.byte() // N
+			}
+			change.doc, change.partial, err = d.tuple(r, rel, true)
+		case 'D':
+			change.op = message.Delete
+			t := r.byte()
+			change.doc, _, err = d.tuple(r, rel, t == 'O')
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, change)
+	}
+
+	if r.err != nil {
+		return nil, commit, r.err
+	}
+	return changes, commit, nil
+}
+
+// tuple reads the values of a row.  values that were too big to store inline and haven't changed aren't sent, in which
+// case partial is true.  a key tuple only has values for the key, the other columns are left out unless nulls is set
+func (d *pgoutputDecoder) tuple(r *pgoutputReader, rel *pgoutputRelation, nulls bool) (doc bson.M, partial bool, err error) {
+	n := int(r.uint16())
+	doc = make(bson.M, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		column := fmt.Sprintf("column%d", i)
+		if i < len(rel.columns) {
+			column = rel.columns[i]
+		}
+
+		switch r.byte() {
+		case 'n':
+			if nulls {
+				doc[column] = nil
+			}
+		case 'u':
+			partial = true
+		case 't':
+			value := string(r.bytes(int(r.uint32())))
+			if doc[column], err = postgresConvert(rel.table.types[column], value); err != nil {
+				return nil, false, fmt.Errorf("%s (%s)", column, err.Error())
+			}
+		}
+	}
+	return doc, partial, r.err
+}
+
+// pgoutputReader reads the fields of a pgoutput message.  reading past the end of the message sets err,
+// and every read after that returns zero values
+type pgoutputReader struct {
+	data []byte
+	err  error
+}
+
+func (r *pgoutputReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("truncated message")
+		}
+		return nil
+	}
+	ba := r.data[:n]
+	r.data = r.data[n:]
+	return ba
+}
+
+func (r *pgoutputReader) byte() byte {
+	if ba := r.bytes(1); ba != nil {
+		return ba[0]
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint16() uint16 {
+	if ba := r.bytes(2); ba != nil {
+		return binary.BigEndian.Uint16(ba)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint32() uint32 {
+	if ba := r.bytes(4); ba != nil {
+		return binary.BigEndian.Uint32(ba)
+	}
+	return 0
+}
+
+func (r *pgoutputReader) uint64() uint64 {
+	if ba := r.bytes(8); ba != nil {
+		return binary.BigEndian.Uint64(ba)
+	}
+	return 0
+}
+
+// string reads a null terminated string
+func (r *pgoutputReader) string() string {
+	i := bytes.IndexByte(r.data, 0)
+	if i < 0 {
+		r.bytes(len(r.data) + 1)
+		return ""
+	}
+	s := string(r.bytes(i))
+	r.bytes(1)
+	return s
+}
+
+func postgresTablesByNamespace(tables []*postgresTable) map[string]*postgresTable {
+	m := make(map[string]*postgresTable, len(tables))
+	for _, t := range tables {
+		m[t.namespace()] = t
+	}
+	return m
+}
+
+// decodePostgresRow decodes a row that was read as json, and converts each of it's columns
+func decodePostgresRow(row string, types map[string]string) (bson.M, error) {
+	var values map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(row))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+
+	doc := make(bson.M, len(values))
+	for column, v := range values {
+		var err error
+		if doc[column], err = postgresConvert(types[column], v); err != nil {
+			return nil, fmt.Errorf("%s (%s)", column, err.Error())
+		}
+	}
+	return doc, nil
+}
+
+// postgresTypeModifier matches the modifier in a type's name, ie. the (255) in character varying(255)
+var postgresTypeModifier = regexp.MustCompile(`\([^)]*\)`)
+
+// postgresTimeLayouts are the ways postgres writes dates and times, as json and as text
+var postgresTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// postgresConvert converts a column's value to the go type for the column's postgres type.  the value is either from json,
+// where numbers, booleans, json columns and arrays have already been decoded, or it's postgres' text for the value.
+// types we don't know about are left as strings
+func postgresConvert(typ string, v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	typ = postgresTypeModifier.ReplaceAllString(typ, "")
+	if strings.HasSuffix(typ, "[]") {
+		var (
+			list []interface{}
+			err  error
+		)
+		switch t := v.(type) {
+		case []interface{}:
+			list = t
+		case string:
+			if list, err = parsePostgresArray(t); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%v isn't an array", v)
+		}
+
+		elem := strings.TrimSuffix(typ, "[]")
+		out := make([]interface{}, len(list))
+		for i := range list {
+			if out[i], err = postgresConvert(elem, list[i]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+
+	s, isString := v.(string)
+	if n, ok := v.(json.Number); ok {
+		s, isString = n.String(), true
+	}
+
+	switch typ {
+	case "boolean":
+		if isString {
+			return s == "t" || s == "true", nil
+		}
+	case "smallint", "integer":
+		if isString {
+			return strconv.Atoi(s)
+		}
+	case "bigint":
+		if isString {
+			return strconv.ParseInt(s, 10, 64)
+		}
+	case "real", "double precision", "numeric":
+		if isString {
+			return strconv.ParseFloat(s, 64)
+		}
+	case "json", "jsonb":
+		if _, ok := v.(string); ok {
+			return decodeJSON([]byte(s))
+		}
+		return jsonValue(v), nil
+	case "date", "timestamp without time zone", "timestamp with time zone":
+		if isString {
+			for _, layout := range postgresTimeLayouts {
+				if t, err := time.Parse(layout, s); err == nil {
+					return t, nil
+				}
+			}
+			return s, nil // infinity, or a date before the common era
+		}
+	case "bytea":
+		if isString && strings.HasPrefix(s, `\x`) {
+			return hex.DecodeString(s[2:])
+		}
+	}
+	return jsonValue(v), nil
+}
+
+// parsePostgresArray splits the text of a one dimensional array, ie. {1,2,NULL,"a \"quoted\" string"}, into it's elements
+func parsePostgresArray(s string) ([]interface{}, error) {
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("malformed array %q", s)
+	}
+	s = s[1 : len(s)-1]
+	if s == "" {
+		return []interface{}{}, nil
+	}
+
+	var (
+		list             []interface{}
+		elem             []byte
+		quoted, inQuotes bool
+	)
+	add := func() {
+		if !quoted && string(elem) == "NULL" {
+			list = append(list, nil)
+		} else {
+			list = append(list, string(elem))
+		}
+		elem, quoted = nil, false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			elem = append(elem, s[i])
+		case c == '"':
+			inQuotes, quoted = !inQuotes, true
+		case c == '{' && !inQuotes:
+			return nil, fmt.Errorf("multidimensional arrays aren't supported")
+		case c == ',' && !inQuotes:
+			add()
+		default:
+			elem = append(elem, c)
+		}
+	}
+	add()
+	return list, nil
+}
@@ -0,0 +1,432 @@
+package adaptor
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/message"
+	"github.com/lib/pq"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// postgresPollInterval is how long a source waits before asking the replication slot for more changes, once it's caught up
+	postgresPollInterval = time.Second
+
+	// postgresPeekSize is roughly the most changes read from the replication slot at once, transactions aren't split up
+	postgresPeekSize = 1000
+)
+
+// the logical decoding plugins that a source can read changes with
+const (
+	postgresWal2json = "wal2json"
+	postgresPgoutput = "pgoutput"
+)
+
+// postgresTable is a table that a source reads from
+type postgresTable struct {
+	schema string
+	name   string
+	key    string            // the primary key column
+	types  map[string]string // the type of each column
+}
+
+func (t *postgresTable) namespace() string {
+	return t.schema + "." + t.name
+}
+
+func (t *postgresTable) quotedName() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name)
+}
+
+// Start the adaptor as a source.  the rows of each table are copied, and then, when tailing, the changes to the tables are
+// streamed from the replication slot.  the slot is only moved on once the sinks have processed the changes, so after a
+// restart we pick up from the last change that was delivered.  changes are delivered at least once
+func (pg *Postgres) Start() (err error) {
+	defer func() {
+		pg.pipe.Stop()
+	}()
+
+	if err = pg.connect(); err != nil {
+		pg.pipe.Err <- NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (%s)", err.Error()), nil)
+		return err
+	}
+	defer pg.db.Close()
+
+	for _, t := range pg.tables {
+		if err = pg.describeTable(t); err != nil {
+			pg.pipe.Err <- NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (can't read table %s, %s)", t.namespace(), err.Error()), nil)
+			return err
+		}
+	}
+
+	resumed := false
+	if pg.tail {
+		if resumed, err = pg.setupSlot(); err != nil {
+			pg.pipe.Err <- NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (can't set up replication slot %s)", err.Error()), nil)
+			return err
+		}
+	}
+
+	// if we're picking up from a checkpoint, the sinks already have the copy
+	if !resumed {
+		startCopy(pg.pipe)
+		if err = pg.copyTables(); err != nil {
+			pg.pipe.Err <- err
+			return err
+		}
+		if pg.pipe.Stopped {
+			return nil
+		}
+
+		position := ""
+		if pg.tail {
+			position = "lsn:" + formatLSN(pg.confirmed)
+		}
+		pg.pipe.Send(message.NewCommandMsg(message.CopyComplete, nil))
+		pg.pipe.Event <- events.NewSnapshotEvent(time.Now().Unix(), pg.path, pg.copied, position)
+	}
+
+	if pg.tail {
+		if err = pg.tailSlot(); err != nil {
+			pg.pipe.Err <- err
+			return err
+		}
+	}
+	return nil
+}
+
+// describeTable reads the types of the table's columns, and finds it's primary key
+func (pg *Postgres) describeTable(t *postgresTable) error {
+	rows, err := pg.db.Query(`SELECT a.attname, format_type(a.atttypid, a.atttypmod), i.indisprimary IS NOT NULL
+		FROM pg_attribute a
+		LEFT JOIN pg_index i ON i.indrelid = a.attrelid AND a.attnum = ANY(i.indkey) AND i.indisprimary
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped`, t.quotedName())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []string
+	t.types = make(map[string]string)
+	for rows.Next() {
+		var (
+			column, typ string
+			primary     bool
+		)
+		if err = rows.Scan(&column, &typ, &primary); err != nil {
+			return err
+		}
+		t.types[column] = typ
+		if primary {
+			keys = append(keys, column)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(keys) != 1 {
+		return fmt.Errorf("the table needs a single column primary key")
+	}
+	t.key = keys[0]
+	return nil
+}
+
+// setupSlot creates the replication slot, and the publication for pgoutput, if they don't already exist.
+// if the slot exists and a position has been checkpointed, the slot is moved on to the checkpoint, in case it was saved
+// after the sinks caught up but before the slot was confirmed.  setupSlot returns true if we're resuming from a checkpoint
+func (pg *Postgres) setupSlot() (bool, error) {
+	if pg.plugin == postgresPgoutput {
+		if err := pg.createPublication(); err != nil {
+			return false, err
+		}
+	}
+
+	var plugin, confirmed sql.NullString
+	err := pg.db.QueryRow("SELECT plugin, confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1", pg.slot).Scan(&plugin, &confirmed)
+	if err == sql.ErrNoRows {
+		// the slot keeps every change made from now on, so it has to exist before the copy starts.
+		// changes made during the copy are streamed afterwards, which is harmless as they're applied in order
+		var lsn string
+		if err = pg.db.QueryRow("SELECT lsn::text FROM pg_create_logical_replication_slot($1, $2)", pg.slot, pg.plugin).Scan(&lsn); err != nil {
+			return false, err
+		}
+		pg.confirmed, err = parseLSN(lsn)
+		return false, err
+	} else if err != nil {
+		return false, err
+	}
+	if plugin.String != pg.plugin {
+		return false, fmt.Errorf("slot %s doesn't use %s", pg.slot, pg.plugin)
+	}
+	if pg.confirmed, err = parseLSN(confirmed.String); err != nil {
+		return false, err
+	}
+
+	var position string
+	if ok, err := pg.checkpoint.Get("lsn", &position); !ok || err != nil {
+		return false, err
+	}
+	lsn, err := parseLSN(position)
+	if err != nil {
+		return false, err
+	}
+	if lsn > pg.confirmed {
+		if err = pg.advanceSlot(lsn); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// createPublication creates a publication for our tables, unless there's one already
+func (pg *Postgres) createPublication() error {
+	var exists bool
+	if err := pg.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", pg.publication).Scan(&exists); err != nil || exists {
+		return err
+	}
+
+	tables := make([]string, len(pg.tables))
+	for i, t := range pg.tables {
+		tables[i] = t.quotedName()
+	}
+	_, err := pg.db.Exec(fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", pq.QuoteIdentifier(pg.publication), strings.Join(tables, ", ")))
+	return err
+}
+
+// copyTables sends an insert for every row in the tables.  the tables are read in one transaction, so the copy is consistent
+func (pg *Postgres) copyTables() error {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (%s)", err.Error()), nil)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY"); err != nil {
+		return NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (%s)", err.Error()), nil)
+	}
+
+	for _, t := range pg.tables {
+		if err = pg.copyTable(tx, t); err != nil {
+			return NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (can't copy %s, %s)", t.namespace(), err.Error()), nil)
+		}
+		if pg.pipe.Stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (pg *Postgres) copyTable(tx *sql.Tx, t *postgresTable) error {
+	rows, err := tx.Query(fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", t.quotedName()))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	meta := pg.meta(t, pg.confirmed)
+	for rows.Next() {
+		if pg.pipe.Stopped {
+			return nil
+		}
+
+		var row string
+		if err = rows.Scan(&row); err != nil {
+			return err
+		}
+		doc, err := decodePostgresRow(row, t.types)
+		if err != nil {
+			pg.pipe.Err <- NewError(ERROR, pg.path, fmt.Sprintf("Postgres error (can't convert row %s)", err.Error()), bson.M{"row": row})
+			continue
+		}
+
+		msg := t.message(message.Insert, doc)
+		msg.Meta = meta
+		pg.pipe.Send(msg)
+		pg.copied++
+	}
+	return rows.Err()
+}
+
+// tailSlot streams changes from the replication slot until the pipeline stops.  changes are read without consuming them,
+// and once the sinks have dealt with them, the slot is moved on past them
+func (pg *Postgres) tailSlot() error {
+	var decoder postgresDecoder
+	if pg.plugin == postgresPgoutput {
+		decoder = newPgoutputDecoder(pg.tables)
+	} else {
+		decoder = newWal2jsonDecoder(pg.tables)
+	}
+
+	// don't save our position until the sinks have the copy, or a restart would skip it
+	if !waitForSinks(pg.pipe) {
+		return nil
+	}
+	pg.saveCheckpoint(true)
+	defer pg.saveCheckpoint(true)
+
+	for !pg.pipe.Stopped {
+		end, err := pg.readChanges(decoder)
+		if err != nil {
+			return NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (can't read replication slot %s)", err.Error()), nil)
+		}
+
+		if end <= pg.confirmed { // nothing new, wait for more changes
+			time.Sleep(postgresPollInterval)
+			continue
+		}
+
+		if !waitForSinks(pg.pipe) {
+			return nil
+		}
+		if err = pg.advanceSlot(end); err != nil {
+			return NewError(CRITICAL, pg.path, fmt.Sprintf("Postgres error (can't confirm replication slot %s)", err.Error()), nil)
+		}
+		pg.saveCheckpoint(false)
+	}
+	return nil
+}
+
+// readChanges sends the changes that are waiting in the slot, and returns the position of the end of the last
+// transaction that was read.  transactions that we've already delivered are skipped
+func (pg *Postgres) readChanges(decoder postgresDecoder) (uint64, error) {
+	var query string
+	if pg.plugin == postgresPgoutput {
+		query = "SELECT lsn::text, data FROM pg_logical_slot_peek_binary_changes($1, NULL, $2, 'proto_version', '1', 'publication_names', $3)"
+	} else {
+		query = "SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'add-tables', $3)"
+	}
+	rows, err := pg.db.Query(query, pg.slot, postgresPeekSize, pg.pluginTables())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var end uint64
+	for rows.Next() {
+		var (
+			position string
+			data     []byte
+		)
+		if err = rows.Scan(&position, &data); err != nil {
+			return 0, err
+		}
+		lsn, err := parseLSN(position)
+		if err != nil {
+			return 0, err
+		}
+
+		changes, commit, err := decoder.decode(lsn, data, pg.confirmed)
+		if err != nil {
+			pg.pipe.Err <- NewError(ERROR, pg.path, fmt.Sprintf("Postgres error (can't decode change at %s, %s)", position, err.Error()), nil)
+		}
+		for _, c := range changes {
+			for _, msg := range c.messages() {
+				msg.Meta = pg.meta(c.table, lsn)
+				pg.pipe.Send(msg)
+			}
+		}
+		if commit > end {
+			end = commit
+		}
+	}
+	return end, rows.Err()
+}
+
+// pluginTables is the option that tells the plugin which tables we're interested in.  pgoutput is given the publication,
+// and wal2json a list of schema.table
+func (pg *Postgres) pluginTables() string {
+	if pg.plugin == postgresPgoutput {
+		return pg.publication
+	}
+	tables := make([]string, len(pg.tables))
+	for i, t := range pg.tables {
+		tables[i] = t.namespace()
+	}
+	return strings.Join(tables, ",")
+}
+
+// advanceSlot confirms that we're done with the changes in the slot up to lsn, so that postgres can throw them away
+func (pg *Postgres) advanceSlot(lsn uint64) error {
+	if _, err := pg.db.Exec("SELECT pg_replication_slot_advance($1, $2::pg_lsn)", pg.slot, formatLSN(lsn)); err != nil {
+		return err
+	}
+	pg.confirmed = lsn
+	return nil
+}
+
+// saveCheckpoint records the position in the slot that's been delivered
+func (pg *Postgres) saveCheckpoint(force bool) {
+	pg.checkpoint.Set("lsn", formatLSN(pg.confirmed))
+	if err := pg.checkpoint.Save(force); err != nil {
+		pg.pipe.Err <- NewError(ERROR, pg.path, fmt.Sprintf("Postgres error (can't save checkpoint %s)", err.Error()), nil)
+	}
+}
+
+// meta is the metadata for a row from the table.  when tailing, lsn is the position of the change in the slot,
+// or for copied rows, the position the slot started at
+func (pg *Postgres) meta(t *postgresTable, lsn uint64) bson.M {
+	meta := bson.M{"namespace": t.namespace()}
+	if pg.tail {
+		meta["lsn"] = formatLSN(lsn)
+	}
+	return meta
+}
+
+// message wraps a row in a message.  the document id is the primary key, a key that isn't id is copied to _id
+func (t *postgresTable) message(op message.OpType, doc bson.M) *message.Msg {
+	if t.key != "id" && t.key != "_id" {
+		doc["_id"] = doc[t.key]
+	}
+	return message.NewMsg(op, doc)
+}
+
+// postgresChange is a change to one row of a table, decoded from the replication slot
+type postgresChange struct {
+	table   *postgresTable
+	op      message.OpType
+	doc     bson.M // the row, or for deletes, the key of the row that was deleted
+	old     bson.M // for updates, the key of the row before it was updated, or the whole row, if the plugin told us
+	partial bool   // the row is missing values that didn't change
+}
+
+// messages turns the change into messages.  an update that changes the primary key becomes a delete of the old row,
+// and an insert of the new one
+func (c *postgresChange) messages() []*message.Msg {
+	if c.op == message.Update && c.old != nil {
+		if oldKey, ok := c.old[c.table.key]; ok && !reflect.DeepEqual(oldKey, c.doc[c.table.key]) {
+			op := message.Insert
+			if c.partial {
+				op = message.Update
+			}
+			msg := c.table.message(op, c.doc)
+			msg.Partial = c.partial
+			return []*message.Msg{c.table.message(message.Delete, c.old), msg}
+		}
+	}
+
+	msg := c.table.message(c.op, c.doc)
+	msg.Partial = c.partial
+	if c.op == message.Update {
+		msg.Before = c.old
+	}
+	return []*message.Msg{msg}
+}
+
+// parseLSN parses a position in the write ahead log, as written by postgres, ie. 16/B374D848
+func parseLSN(s string) (uint64, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("malformed lsn %q", s)
+	}
+	return uint64(hi)<<32 | uint64(lo), nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
@@ -0,0 +1,267 @@
+package adaptor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPostgresStatement(t *testing.T) {
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+
+	partial := message.NewMsg(message.Update, bson.M{"_id": id, "title": "hello"})
+	partial.Partial = true
+
+	data := []struct {
+		extra Config
+		msg   *message.Msg
+		query string
+		args  []interface{}
+	}{
+		{
+			Config{},
+			message.NewMsg(message.Insert, bson.M{"_id": id, "title": "hello", "views": 10}),
+			`INSERT INTO "public"."posts" ("id", "data") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "data" = EXCLUDED."data"`,
+			[]interface{}{id.Hex(), `{"title":"hello","views":10}`},
+		},
+		{
+			Config{},
+			partial,
+			`INSERT INTO "public"."posts" ("id", "data") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "data" = "public"."posts"."data" || EXCLUDED."data"`,
+			[]interface{}{id.Hex(), `{"title":"hello"}`},
+		},
+		{
+			Config{},
+			message.NewMsg(message.Delete, bson.M{"_id": id}),
+			`DELETE FROM "public"."posts" WHERE "id" = $1`,
+			[]interface{}{id.Hex()},
+		},
+		{
+			Config{"mode": "columns", "columns": map[string]string{"title": "text", "views": "integer", "tags": "jsonb"}},
+			message.NewMsg(message.Insert, bson.M{"_id": id, "title": "hello", "tags": []interface{}{"a"}, "ignored": true}),
+			`INSERT INTO "public"."posts" ("id", "tags", "title", "views") VALUES ($1, $2, $3, $4) ON CONFLICT ("id") DO UPDATE SET "tags" = EXCLUDED."tags", "title" = EXCLUDED."title", "views" = EXCLUDED."views"`,
+			[]interface{}{id.Hex(), `["a"]`, "hello", nil},
+		},
+		{
+			Config{"mode": "columns", "columns": map[string]string{"title": "text", "views": "integer"}},
+			partial,
+			`INSERT INTO "public"."posts" ("id", "title") VALUES ($1, $2) ON CONFLICT ("id") DO UPDATE SET "title" = EXCLUDED."title"`,
+			[]interface{}{id.Hex(), "hello"},
+		},
+	}
+
+	for _, v := range data {
+		v.extra["uri"] = "postgres://localhost/test"
+		v.extra["namespace"] = "public.posts"
+		a, err := NewPostgres(pipe.NewPipe(nil, "some name"), "a/b/c", v.extra)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", v.extra, err)
+			continue
+		}
+		query, args, err := a.(*Postgres).statement(v.msg)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", v.msg.Document(), err)
+			continue
+		}
+		if query != v.query {
+			t.Errorf("expected: %s\ngot: %s", v.query, query)
+		}
+		if !reflect.DeepEqual(args, v.args) {
+			t.Errorf("expected: %v, got: %v", v.args, args)
+		}
+	}
+}
+
+func TestPostgresConvert(t *testing.T) {
+	data := []struct {
+		typ string
+		in  interface{}
+		out interface{}
+	}{
+		{"integer", json.Number("10"), 10},
+		{"integer", "10", 10},
+		{"bigint", "9007199254740993", int64(9007199254740993)},
+		{"numeric(10,2)", json.Number("1.50"), 1.5},
+		{"boolean", true, true},
+		{"boolean", "t", true},
+		{"character varying(255)", "hello", "hello"},
+		{"jsonb", `{"a": [1, "b"]}`, bson.M{"a": []interface{}{1, "b"}}},
+		{"json", map[string]interface{}{"a": json.Number("1.5")}, bson.M{"a": 1.5}},
+		{"timestamp with time zone", "2016-01-02 10:00:00.5+00", time.Date(2016, 1, 2, 10, 0, 0, 500000000, time.FixedZone("", 0))},
+		{"timestamp without time zone", "2016-01-02T10:00:00", time.Date(2016, 1, 2, 10, 0, 0, 0, time.UTC)},
+		{"date", "2016-01-02", time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"bytea", `\x6869`, []byte("hi")},
+		{"integer[]", "{1,2,NULL}", []interface{}{1, 2, nil}},
+		{"text[]", `{a,"b,c","say \"hi\"","NULL"}`, []interface{}{"a", "b,c", `say "hi"`, "NULL"}},
+		{"text[]", []interface{}{"a", nil}, []interface{}{"a", nil}},
+		{"integer", nil, nil},
+	}
+
+	for _, v := range data {
+		out, err := postgresConvert(v.typ, v.in)
+		if err != nil {
+			t.Errorf("%s %v: unexpected error: %v", v.typ, v.in, err)
+			continue
+		}
+		if tm, ok := out.(time.Time); ok {
+			if !tm.Equal(v.out.(time.Time)) {
+				t.Errorf("%s %v: expected %v, got %v", v.typ, v.in, v.out, tm)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(out, v.out) {
+			t.Errorf("%s %v: expected %#v, got %#v", v.typ, v.in, v.out, out)
+		}
+	}
+}
+
+func TestWal2jsonDecode(t *testing.T) {
+	users := &postgresTable{schema: "public", name: "users", key: "user_id"}
+	d := newWal2jsonDecoder([]*postgresTable{users})
+
+	tx := `{"change":[
+		{"kind":"insert","schema":"public","table":"users","columnnames":["user_id","name","tags"],"columntypes":["integer","text","text[]"],"columnvalues":[1,"bob","{a,b}"]},
+		{"kind":"insert","schema":"public","table":"other","columnnames":["id"],"columntypes":["integer"],"columnvalues":[1]},
+		{"kind":"update","schema":"public","table":"users","columnnames":["user_id","name","tags"],"columntypes":["integer","text","text[]"],"columnvalues":[2,"bob",null],
+			"oldkeys":{"keynames":["user_id"],"keytypes":["integer"],"keyvalues":[1]}},
+		{"kind":"delete","schema":"public","table":"users","oldkeys":{"keynames":["user_id"],"keytypes":["integer"],"keyvalues":[2]}}
+	]}`
+
+	changes, commit, err := d.decode(100, []byte(tx), 50)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commit != 100 {
+		t.Errorf("expected the transaction to end at 100, got %d", commit)
+	}
+
+	var msgs []*message.Msg
+	for _, c := range changes {
+		msgs = append(msgs, c.messages()...)
+	}
+	expected := []struct {
+		op  message.OpType
+		doc bson.M
+	}{
+		{message.Insert, bson.M{"_id": 1, "user_id": 1, "name": "bob", "tags": []interface{}{"a", "b"}}},
+		{message.Delete, bson.M{"_id": 1, "user_id": 1}},
+		{message.Insert, bson.M{"_id": 2, "user_id": 2, "name": "bob", "tags": nil}},
+		{message.Delete, bson.M{"_id": 2, "user_id": 2}},
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %d", len(expected), len(msgs))
+	}
+	for i, v := range expected {
+		if msgs[i].Op != v.op || !reflect.DeepEqual(msgs[i].Document(), v.doc) {
+			t.Errorf("%d: expected %s %v, got %s %v", i, v.op, v.doc, msgs[i].Op, msgs[i].Document())
+		}
+	}
+
+	// transactions that have already been delivered are skipped
+	if changes, _, _ = d.decode(100, []byte(tx), 100); len(changes) != 0 {
+		t.Errorf("expected a delivered transaction to be skipped, got %d changes", len(changes))
+	}
+}
+
+// pgoutputMessage builds a pgoutput message out of bytes, strings (which are null terminated) and integers
+func pgoutputMessage(fields ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, f := range fields {
+		switch v := f.(type) {
+		case byte:
+			buf.WriteByte(v)
+		case string:
+			buf.WriteString(v)
+			buf.WriteByte(0)
+		case []byte:
+			binary.Write(&buf, binary.BigEndian, uint32(len(v)))
+			buf.Write(v)
+		default:
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestPgoutputDecode(t *testing.T) {
+	users := &postgresTable{schema: "public", name: "users", key: "id", types: map[string]string{"id": "integer", "name": "text", "bio": "text"}}
+	d := newPgoutputDecoder([]*postgresTable{users})
+
+	rows := [][]byte{
+		pgoutputMessage(byte('B'), uint64(200), uint64(0), uint32(7)),
+		pgoutputMessage(byte('R'), uint32(16384), "public", "users", byte('d'), uint16(3),
+			byte(1), "id", uint32(23), uint32(0xffffffff),
+			byte(0), "name", uint32(25), uint32(0xffffffff),
+			byte(0), "bio", uint32(25), uint32(0xffffffff)),
+		pgoutputMessage(byte('I'), uint32(16384), byte('N'), uint16(3), byte('t'), []byte("1"), byte('t'), []byte("bob"), byte('n')),
+		pgoutputMessage(byte('U'), uint32(16384), byte('N'), uint16(3), byte('t'), []byte("1"), byte('t'), []byte("robert"), byte('u')),
+		pgoutputMessage(byte('D'), uint32(16384), byte('K'), uint16(3), byte('t'), []byte("1"), byte('n'), byte('n')),
+		pgoutputMessage(byte('C'), byte(0), uint64(200), uint64(250), uint64(0)),
+	}
+
+	var (
+		changes []*postgresChange
+		commit  uint64
+	)
+	for _, row := range rows {
+		c, end, err := d.decode(0, row, 100)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		changes = append(changes, c...)
+		if end > 0 {
+			commit = end
+		}
+	}
+	if commit != 250 {
+		t.Errorf("expected the transaction to end at 250, got %d", commit)
+	}
+
+	expected := []postgresChange{
+		{table: users, op: message.Insert, doc: bson.M{"id": 1, "name": "bob", "bio": nil}},
+		{table: users, op: message.Update, doc: bson.M{"id": 1, "name": "robert"}, partial: true},
+		{table: users, op: message.Delete, doc: bson.M{"id": 1}},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+	}
+	for i, v := range expected {
+		if !reflect.DeepEqual(*changes[i], v) {
+			t.Errorf("%d: expected %+v, got %+v", i, v, *changes[i])
+		}
+	}
+
+	// the transaction ended before the confirmed position, so it's skipped
+	d.decode(0, rows[0], 300)
+	if c, _, _ := d.decode(0, rows[2], 300); len(c) != 0 {
+		t.Errorf("expected a delivered transaction to be skipped, got %d changes", len(c))
+	}
+
+	d.decode(0, rows[5], 300)
+	if _, _, err := d.decode(0, rows[2][:10], 0); err == nil {
+		t.Errorf("expected an error decoding a truncated message")
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	lsn, err := parseLSN("16/B374D848")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lsn != 0x16B374D848 {
+		t.Errorf("expected %X, got %X", 0x16B374D848, lsn)
+	}
+	if s := formatLSN(lsn); s != "16/B374D848" {
+		t.Errorf("expected 16/B374D848, got %s", s)
+	}
+	if _, err = parseLSN("nope"); err == nil {
+		t.Errorf("expected an error parsing a malformed lsn")
+	}
+}
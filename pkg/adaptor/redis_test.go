@@ -0,0 +1,241 @@
+package adaptor
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"github.com/gomodule/redigo/redis"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// fakeRedisConn records the commands that are flushed to it, and replies to each one with an error if it's for the
+// key in fail
+type fakeRedisConn struct {
+	buffered []string
+	sent     []string
+	replies  []interface{}
+	fail     string
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+
+func (c *fakeRedisConn) Flush() error {
+	c.sent = append(c.sent, c.buffered...)
+	c.buffered = nil
+	return nil
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	c.buffered = append(c.buffered, redisCommandString(cmd, args))
+	if len(args) > 0 && args[0] == c.fail {
+		c.replies = append(c.replies, redis.Error("ERR failed"))
+	} else {
+		c.replies = append(c.replies, "OK")
+	}
+	return nil
+}
+
+func (c *fakeRedisConn) Receive() (interface{}, error) {
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// redisCommandString formats a command, with the field value pairs of a HSET sorted, so it can be compared
+func redisCommandString(cmd string, args []interface{}) string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		if ba, ok := arg.([]byte); ok {
+			arg = string(ba)
+		}
+		strs[i] = fmt.Sprintf("%v", arg)
+	}
+	if cmd == "HSET" {
+		var pairs []string
+		for i := 1; i+1 < len(strs); i += 2 {
+			pairs = append(pairs, strs[i]+" "+strs[i+1])
+		}
+		sort.Strings(pairs)
+		strs = append(strs[:1], pairs...)
+	}
+	return fmt.Sprintf("%s %v", cmd, strs)
+}
+
+func TestRedisCommands(t *testing.T) {
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	partial := message.NewMsg(message.Update, bson.M{"_id": id, "name": "bob"})
+	partial.Partial = true
+
+	data := []struct {
+		conf Config
+		in   *message.Msg
+		sent []string
+	}{
+		{
+			Config{"namespace": "app.users", "relaxed": true},
+			message.NewMsg(message.Insert, bson.M{"_id": id, "name": "alice", "age": 30}),
+			[]string{`SET [app.users:546656989330a846dc7ce327 {"_id":{"$oid":"546656989330a846dc7ce327"},"age":30,"name":"alice"}]`},
+		},
+		{
+			Config{"namespace": "app.users", "key": "user:{{.ID}}", "relaxed": true, "ttl": "1h"},
+			message.NewMsg(message.Update, bson.M{"_id": 1, "name": "alice"}),
+			[]string{`SET [user:1 {"_id":1,"name":"alice"} PX 3600000]`},
+		},
+		{
+			Config{"namespace": "app.users", "key": "user:{{.ID}}", "mode": "hash", "ttl": "10s"},
+			message.NewMsg(message.Update, bson.M{"_id": id, "name": "alice", "tags": []interface{}{"a"}}),
+			[]string{
+				"DEL [user:546656989330a846dc7ce327]",
+				`HSET [user:546656989330a846dc7ce327 _id 546656989330a846dc7ce327 name alice tags ["a"]]`,
+				"PEXPIRE [user:546656989330a846dc7ce327 10000]",
+			},
+		},
+		{
+			Config{"namespace": "app.users", "key": "user:{{.ID}}", "mode": "hash"},
+			partial,
+			[]string{"HSET [user:546656989330a846dc7ce327 _id 546656989330a846dc7ce327 name bob]"},
+		},
+		{
+			Config{"namespace": "app.users", "key": "user:{{.ID}}", "channel": "changes.{{.Namespace}}", "relaxed": true},
+			message.NewMsg(message.Delete, bson.M{"_id": 1}),
+			[]string{
+				"DEL [user:1]",
+				`PUBLISH [changes.app.users {"after":null,"before":{"_id":1},"key":1,"namespace":"app.users","op":"delete","partial":false,"ts":0}]`,
+			},
+		},
+		{
+			Config{"namespace": "app.users", "mode": "stream", "max_len": 1000, "relaxed": true},
+			message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "alice"}),
+			[]string{`XADD [app.users MAXLEN ~ 1000 * envelope {"after":{"_id":1,"name":"alice"},"before":null,"key":1,"namespace":"app.users","op":"insert","partial":false,"ts":0}]`},
+		},
+		{
+			Config{"namespace": "app.users", "mode": "stream", "key": "changes", "relaxed": true},
+			message.NewCommandMsg(message.Drop, nil),
+			[]string{`XADD [changes * envelope {"after":{"drop":true},"before":null,"key":null,"namespace":"app.users","op":"command","partial":false,"ts":0}]`},
+		},
+	}
+
+	for i, v := range data {
+		a, err := NewRedis(pipe.NewPipe(nil, "some name"), "a/b/c", v.conf)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		r := a.(*Redis)
+		conn := &fakeRedisConn{}
+		r.conn = conn
+
+		v.in.Timestamp = 0
+		r.applyOp(v.in)
+		if len(conn.sent) != 0 {
+			t.Errorf("%d: expected the commands to be pipelined until a flush", i)
+		}
+		r.applyOp(message.NewCommandMsg(message.Flush, nil))
+		if !reflect.DeepEqual(conn.sent, v.sent) {
+			t.Errorf("%d: expected %v, got %v", i, v.sent, conn.sent)
+		}
+	}
+}
+
+func TestRedisErrors(t *testing.T) {
+	p := pipe.NewPipe(nil, "some name")
+	a, err := NewRedis(p, "a/b/c", Config{"namespace": "app.users", "batch_size": 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := a.(*Redis)
+	r.conn = &fakeRedisConn{fail: "app.users:2"}
+
+	errs := make(chan error, 10)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+
+	partial := message.NewMsg(message.Update, bson.M{"_id": 3, "name": "c"})
+	partial.Partial = true
+	r.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "a"}))
+	r.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 2, "name": "b"})) // a batch, sent without a flush
+	r.applyOp(partial)                                                       // json can't be partially updated
+
+	for _, expected := range []struct {
+		str    string
+		record bson.M
+	}{
+		{"ERR failed", bson.M{"_id": 2, "name": "b"}},
+		{"partial", bson.M{"_id": 3, "name": "c"}},
+	} {
+		e, ok := (<-errs).(Error)
+		if !ok || e.Lvl != ERROR || !strings.Contains(e.Str, expected.str) || !reflect.DeepEqual(e.Record, expected.record) {
+			t.Errorf("expected an ERROR about %s for %v, got %+v", expected.str, expected.record, e)
+		}
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("expected the batch to have been sent, got %d pending", len(r.pending))
+	}
+}
+
+func TestRedisStreamEntries(t *testing.T) {
+	envelope := `{"op": "update", "namespace": "app.users", "key": 1, "before": {"_id": 1, "name": "a"}, "after": {"_id": 1, "name": "b"}, "ts": 10}`
+	reply := []interface{}{
+		[]interface{}{[]byte("app.users"), []interface{}{
+			[]interface{}{[]byte("1-0"), []interface{}{[]byte("envelope"), []byte(envelope)}},
+			[]interface{}{[]byte("1-1"), nil}, // deleted before it was acknowledged
+		}},
+		[]interface{}{[]byte("events"), []interface{}{
+			[]interface{}{[]byte("2-0"), []interface{}{[]byte("name"), []byte("signup")}},
+		}},
+	}
+
+	entries, err := redisStreamEntries(reply)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ids := redisEntryIDs(entries)
+	if !reflect.DeepEqual(ids, map[string][]interface{}{"app.users": {"1-0", "1-1"}, "events": {"2-0"}}) {
+		t.Errorf("unexpected entries %v", ids)
+	}
+	if entries[1].fields != nil {
+		t.Errorf("expected the deleted entry to have no fields, got %v", entries[1].fields)
+	}
+
+	msg, err := entries[0].message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Op != message.Update || msg.ID != 1 || msg.Before["name"] != "a" || msg.Document()["name"] != "b" || msg.Timestamp != 10 {
+		t.Errorf("unexpected message %s %v %v", msg.Op, msg.Before, msg.Document())
+	}
+	if !reflect.DeepEqual(msg.Meta, bson.M{"stream": "app.users", "id": "1-0", "namespace": "app.users"}) {
+		t.Errorf("unexpected meta %v", msg.Meta)
+	}
+
+	// entries without an envelope are inserts of their fields
+	msg, err = entries[2].message()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.Op != message.Insert || msg.ID != "2-0" || msg.Document()["name"] != "signup" {
+		t.Errorf("unexpected message %s %v", msg.Op, msg.Document())
+	}
+
+	if entries, err := redisStreamEntries(nil); err != nil || len(entries) != 0 {
+		t.Errorf("expected no entries when the read times out, got %v (%v)", entries, err)
+	}
+	if _, err := redisStreamEntries([]interface{}{[]byte("app.users")}); err == nil {
+		t.Errorf("expected an error for a malformed reply")
+	}
+}
@@ -4,14 +4,32 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/compose/transporter/pkg/events"
+	"github.com/compose/transporter/pkg/extjson"
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 	gorethink "github.com/dancannon/gorethink"
+	"gopkg.in/mgo.v2/bson"
 )
 
-// Rethinkdb is an adaptor that writes metrics to rethinkdb (http://rethinkdb.com/)
+const (
+	// rethinkBatchSize is the default number of documents written in one insert
+	rethinkBatchSize = 500
+
+	// rethinkFlushInterval is the longest a document waits in a batch before it's written
+	rethinkFlushInterval = time.Second
+)
+
+// what the sink does to the table when it starts, it's left alone by default
+const (
+	rethinkSetupCreate   = "create"   // create the database and table if they don't exist
+	rethinkSetupTruncate = "truncate" // create them if they don't exist, and delete everything in the table
+)
+
+// Rethinkdb is an adaptor that reads and writes documents to rethinkdb (http://rethinkdb.com/)
 // An open-source distributed database
 type Rethinkdb struct {
 	// pull these in from the config
@@ -21,7 +39,26 @@ type Rethinkdb struct {
 	database string
 	table    string
 
-	debug bool
+	debug    bool
+	commands string // what to do with commands from the source
+	setup    string // what to do to the table on start up
+
+	// inserts and updates are batched up, keyed by id so that a document only appears in a batch once
+	batch     []interface{}
+	batchIDs  map[string]int // where each id is in the batch, by it's canonical extended json
+	batchSize int
+	batchLock sync.Mutex
+	done      chan struct{}
+
+	// source options
+	since      string      // an index whose values only ever increase, the checkpoint records how far through it we've read
+	sinceValue interface{} // the largest value of the since index that we've sent
+	checkpoint *checkpoint
+	marks      []rethinkMark // values of the since index that are waiting for the sinks to catch up
+	lastMark   time.Time     // when the last value was marked
+	copied     int           // the number of documents read by the initial read
+	ready      bool          // the initial read is over
+	cursor     *gorethink.Cursor
 
 	//
 	pipe *pipe.Pipe
@@ -34,7 +71,7 @@ type Rethinkdb struct {
 // NewRethinkdb creates a new Rethinkdb database adaptor
 func NewRethinkdb(p *pipe.Pipe, path string, extra Config) (StopStartListener, error) {
 	var (
-		conf dbConfig
+		conf RethinkdbConfig
 		err  error
 	)
 	if err = extra.Construct(&conf); err != nil {
@@ -47,23 +84,216 @@ func NewRethinkdb(p *pipe.Pipe, path string, extra Config) (StopStartListener, e
 	}
 
 	r := &Rethinkdb{
-		uri:  u,
-		pipe: p,
-		path: path,
+		uri:       u,
+		pipe:      p,
+		path:      path,
+		setup:     conf.Setup,
+		batchSize: conf.BatchSize,
+		batchIDs:  make(map[string]int),
+		done:      make(chan struct{}),
+		since:     conf.Since,
+	}
+	if r.batchSize <= 0 {
+		r.batchSize = rethinkBatchSize
+	}
+
+	switch r.setup {
+	case "", rethinkSetupCreate, rethinkSetupTruncate:
+	default:
+		return r, fmt.Errorf("unknown setup %q, expected %q or %q", r.setup, rethinkSetupCreate, rethinkSetupTruncate)
 	}
 
+	// the namespace can leave out the database if it's in the uri, ie. rethinkdb://host:28015/blog with a namespace of posts
 	r.database, r.table, err = extra.splitNamespace()
+	if db := strings.Trim(u.Path, "/"); err != nil && db != "" && extra.GetString("namespace") != "" {
+		r.database, r.table, err = db, extra.GetString("namespace"), nil
+	}
 	if err != nil {
 		return r, err
 	}
 	r.debug = conf.Debug
 
+	r.commands, err = commandsOption(conf.Commands)
+	if err != nil {
+		return r, err
+	}
+
+	r.checkpoint, err = newCheckpoint(conf.Checkpoint)
+	if err != nil {
+		return r, fmt.Errorf("can't load checkpoint (%s)", err.Error())
+	}
+
 	return r, nil
 }
 
-// Start the adaptor as a source (not implemented)
-func (r *Rethinkdb) Start() error {
-	return fmt.Errorf("Rethinkdb can't function as a source")
+// Start the adaptor as a source.  the table is read with a changefeed that includes the table's initial contents,
+// so that there's no gap between reading the table and following the changes.  once the initial read is done, a
+// copy_complete command is sent down the pipe.
+// changefeeds can't be resumed, so after a restart the table is read again, unless there's a since index, in which case
+// only the documents from the last value in the checkpoint onwards are read
+func (r *Rethinkdb) Start() (err error) {
+	defer func() {
+		r.pipe.Stop()
+	}()
+
+	r.client, err = r.connect()
+	if err != nil {
+		r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), nil)
+		return err
+	}
+
+	term := gorethink.Db(r.database).Table(r.table)
+	if r.since != "" {
+		if err = r.restoreCheckpoint(); err != nil {
+			r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (can't restore checkpoint %s)", err.Error()), nil)
+			return err
+		}
+		if r.sinceValue != nil {
+			term = term.Between(r.sinceValue, gorethink.MaxVal, gorethink.BetweenOpts{Index: r.since})
+		}
+	}
+
+	if r.sinceValue == nil { // otherwise the initial read only has what's changed since the checkpoint
+		startCopy(r.pipe)
+	}
+
+	r.cursor, err = term.Changes(gorethink.ChangesOpts{IncludeInitial: true, IncludeStates: true}).Run(r.client)
+	if err != nil {
+		r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (can't follow changes %s)", err.Error()), nil)
+		return err
+	}
+	defer r.cursor.Close()
+
+	var change rethinkChange
+	for r.cursor.Next(&change) {
+		if r.pipe.Stopped {
+			break
+		}
+		r.apply(change)
+		change = rethinkChange{}
+	}
+
+	r.confirmMarks(true)
+	if err = r.cursor.Err(); err != nil && !r.pipe.Stopped {
+		r.pipe.Err <- NewError(CRITICAL, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), nil)
+		return err
+	}
+	return nil
+}
+
+// apply sends a change down the pipe.  the initial read comes back in no particular order, so the largest value of the
+// since index isn't marked until the initial read is over, a restart part way through it would skip the smaller values
+// that were never sent
+func (r *Rethinkdb) apply(change rethinkChange) {
+	if change.State == "ready" {
+		r.ready = true
+		r.pipe.Send(message.NewCommandMsg(message.CopyComplete, nil))
+		r.pipe.Event <- events.NewSnapshotEvent(time.Now().Unix(), r.path, r.copied, "")
+		r.mark()
+	} else if msg := change.message(); msg != nil {
+		r.pipe.Send(msg)
+		if !r.ready {
+			r.copied++
+		}
+		r.track(change.NewVal)
+	}
+
+	r.confirmMarks(false)
+	if r.ready && time.Since(r.lastMark) >= checkpointInterval {
+		r.mark()
+	}
+}
+
+// restoreCheckpoint reads the value of the since index that we'd read up to
+func (r *Rethinkdb) restoreCheckpoint() error {
+	var v interface{}
+	ok, err := r.checkpoint.Get("since", &v)
+	if !ok || err != nil {
+		return err
+	}
+	r.sinceValue, err = extjson.Decode(v) // keep dates as dates
+	return err
+}
+
+// track records the document's value for the since index, if it's the largest we've sent
+func (r *Rethinkdb) track(doc bson.M) {
+	if r.since == "" || doc == nil {
+		return
+	}
+	v, ok := doc[r.since]
+	if !ok {
+		return
+	}
+	if r.sinceValue != nil {
+		if c, ok := compareIDs(v, r.sinceValue); !ok || c <= 0 {
+			return
+		}
+	}
+	r.sinceValue = v
+}
+
+// mark sends a flush down the pipeline, and remembers the largest value of the since index we've sent, so that it can
+// be checkpointed once every sink has processed the flush, and so everything before it
+func (r *Rethinkdb) mark() {
+	r.lastMark = time.Now()
+	if r.checkpoint == nil || r.sinceValue == nil {
+		return
+	}
+	if n := len(r.marks); n > 0 {
+		if c, ok := compareIDs(r.sinceValue, r.marks[n-1].value); ok && c == 0 {
+			return
+		}
+	}
+
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	r.pipe.Send(flush)
+	r.marks = append(r.marks, rethinkMark{receipt: flush.Receipt, value: r.sinceValue})
+}
+
+// confirmMarks checkpoints the largest value of the since index that the sinks have caught up to
+func (r *Rethinkdb) confirmMarks(force bool) {
+	var err error
+	for len(r.marks) > 0 && r.marks[0].receipt.Delivered() && err == nil {
+		var ext interface{}
+		if ext, err = extjson.Encode(r.marks[0].value, extjson.Canonical); err == nil {
+			r.checkpoint.Set("since", ext)
+		}
+		r.marks = r.marks[1:]
+	}
+	if err == nil {
+		err = r.checkpoint.Save(force)
+	}
+	if err != nil {
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (can't save checkpoint %s)", err.Error()), nil)
+	}
+}
+
+// rethinkMark is a value of the since index, and the receipt of a flush that was sent after the document it came from
+type rethinkMark struct {
+	receipt *message.Receipt
+	value   interface{}
+}
+
+// rethinkChange is one result from a changefeed, either a change to a document, or a change in the feed's state
+type rethinkChange struct {
+	NewVal bson.M `gorethink:"new_val"`
+	OldVal bson.M `gorethink:"old_val"`
+	State  string `gorethink:"state"`
+}
+
+// message turns a change into an insert, update or delete.  documents from the initial read of the table
+// don't have an old value, so they're inserts
+func (c rethinkChange) message() *message.Msg {
+	switch {
+	case c.NewVal != nil && c.OldVal == nil:
+		return message.NewMsg(message.Insert, c.NewVal)
+	case c.NewVal != nil:
+		return message.NewMsg(message.Update, c.NewVal)
+	case c.OldVal != nil:
+		return message.NewMsg(message.Delete, c.OldVal)
+	}
+	return nil
 }
 
 // Listen start's the adaptor's listener
@@ -74,55 +304,253 @@ func (r *Rethinkdb) Listen() (err error) {
 		return err
 	}
 
+	// write out batches that haven't filled up
+	go func() {
+		ticker := time.NewTicker(rethinkFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.flush()
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	defer r.flush()
+
 	return r.pipe.Listen(r.applyOp)
 }
 
 // Stop the adaptor
 func (r *Rethinkdb) Stop() error {
 	r.pipe.Stop()
+	if r.cursor != nil { // unblock a source that's waiting for changes
+		r.cursor.Close()
+	}
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+	}
 	return nil
 }
 
-// applyOp applies one operation to the database
+// applyOp applies one operation to the database.  inserts and updates are added to the batch, deletes and partial updates
+// are applied straight away, after the batch has been written so that they happen in the right order
 func (r *Rethinkdb) applyOp(msg *message.Msg) (*message.Msg, error) {
 	var (
 		resp gorethink.WriteResponse
 		err  error
 	)
 
-	switch msg.Op {
-	case message.Delete:
-		resp, err = gorethink.Table(r.table).Get(msg.IDString()).Delete().RunWrite(r.client)
-	case message.Insert:
-		resp, err = gorethink.Table(r.table).Insert(msg.Document()).RunWrite(r.client)
-	case message.Update:
-		resp, err = gorethink.Table(r.table).Insert(msg.DocumentWithID("id"), gorethink.InsertOpts{Conflict: "replace"}).RunWrite(r.client)
+	switch {
+	case msg.Op == message.Command:
+		r.flush()
+		if err = r.runCommand(msg); err != nil {
+			r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), msg.Document())
+		}
+		return msg, nil
+	case msg.Op == message.Delete:
+		r.flush()
+		resp, err = gorethink.Db(r.database).Table(r.table).Get(rethinkID(msg)).Delete().RunWrite(r.client)
+	case msg.Op == message.Update && msg.Partial:
+		r.flush()
+		resp, err = gorethink.Db(r.database).Table(r.table).Get(rethinkID(msg)).Update(msg.Document()).RunWrite(r.client)
+	default:
+		r.add(msg)
+		return msg, nil
+	}
+	if err == nil {
+		err = r.handleResponse(&resp)
+	}
+	if err != nil {
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (%s)", err.Error()), msg.Document())
+	}
+	return msg, nil
+}
+
+// add puts the document in the batch, replacing an earlier version of the same document, and writes the batch if it's full.
+// the message is shared with the other sinks, so the document is copied before it's given it's rethinkdb id.
+// ids are matched up by their extended json, as compound ids can't be map keys
+func (r *Rethinkdb) add(msg *message.Msg) {
+	doc := bson.M{}
+	for k, v := range msg.Document() {
+		doc[k] = v
+	}
+	doc["id"] = rethinkID(msg)
+	key, err := extjson.Marshal(doc["id"], extjson.Canonical)
+	if err != nil {
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (can't encode id %s)", err.Error()), msg.Document())
+		return
+	}
+
+	r.batchLock.Lock()
+	if i, ok := r.batchIDs[string(key)]; ok {
+		r.batch[i] = doc
+	} else {
+		r.batchIDs[string(key)] = len(r.batch)
+		r.batch = append(r.batch, doc)
+	}
+	full := len(r.batch) >= r.batchSize
+	r.batchLock.Unlock()
+
+	if full {
+		r.flush()
+	}
+}
+
+// flush writes the batch to the table.  documents that are already in the table are replaced
+func (r *Rethinkdb) flush() {
+	r.batchLock.Lock()
+	defer r.batchLock.Unlock()
+
+	if len(r.batch) == 0 {
+		return
+	}
+	batch := r.batch
+	r.batch = nil
+	r.batchIDs = make(map[string]int)
+
+	resp, err := gorethink.Db(r.database).Table(r.table).Insert(batch, gorethink.InsertOpts{Conflict: "replace"}).RunWrite(r.client)
+	if err == nil {
+		err = r.handleResponse(&resp)
 	}
 	if err != nil {
-		return msg, err
+		r.pipe.Err <- NewError(ERROR, r.path, fmt.Sprintf("Rethinkdb error (%d documents not written, %s)", len(batch), err.Error()), nil)
 	}
+}
 
-	return msg, r.handleResponse(&resp)
+// rethinkID is the primary key for the message's document.  ObjectIds are stored as their hex string
+func rethinkID(msg *message.Msg) interface{} {
+	if id, ok := msg.ID.(bson.ObjectId); ok {
+		return id.Hex()
+	}
+	return msg.ID
 }
 
+// setupClient connects to rethinkdb, and sets up the table according to the setup option
 func (r *Rethinkdb) setupClient() (*gorethink.Session, error) {
-	// set up the clientConfig, we need host:port, username, password, and database name
-	client, err := gorethink.Connect(gorethink.ConnectOpts{
+	client, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.setup {
+	case rethinkSetupCreate:
+		err = r.createTable(client)
+	case rethinkSetupTruncate:
+		if err = r.createTable(client); err == nil {
+			_, err = gorethink.Db(r.database).Table(r.table).Delete().RunWrite(client)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up table %s.%s: %s", r.database, r.table, err)
+	}
+	return client, nil
+}
+
+func (r *Rethinkdb) connect() (*gorethink.Session, error) {
+	// set up the clientConfig, we need host:port, auth key, and database name
+	opts := gorethink.ConnectOpts{
 		Address:     r.uri.Host,
+		Database:    r.database,
 		MaxIdle:     10,
 		IdleTimeout: time.Second * 10,
-	})
+	}
+	if r.uri.User != nil { // the auth key can be given as the user or the password, ie. rethinkdb://:authkey@host:28015
+		opts.AuthKey = r.uri.User.Username()
+		if key, set := r.uri.User.Password(); set {
+			opts.AuthKey = key
+		}
+	}
+
+	client, err := gorethink.Connect(opts)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect: %s", err)
 	}
 
-	gorethink.Db(r.database).TableDrop(r.table).RunWrite(client)
-	gorethink.Db(r.database).TableCreate(r.table).RunWrite(client)
-
 	client.Use(r.database)
 	return client, nil
 }
 
+// createTable creates the database and table, unless they already exist
+func (r *Rethinkdb) createTable(client *gorethink.Session) error {
+	exists, err := rethinkContains(gorethink.DbList(), client, r.database)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if _, err = gorethink.DbCreate(r.database).RunWrite(client); err != nil {
+			return err
+		}
+	}
+
+	exists, err = rethinkContains(gorethink.Db(r.database).TableList(), client, r.table)
+	if err != nil || exists {
+		return err
+	}
+	_, err = gorethink.Db(r.database).TableCreate(r.table).RunWrite(client)
+	return err
+}
+
+// rethinkContains runs a query that returns a list of names, ie. DbList, and reports whether name is in the list
+func rethinkContains(term gorethink.Term, client *gorethink.Session, name string) (bool, error) {
+	cursor, err := term.Run(client)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+
+	var names []string
+	if err = cursor.All(&names); err != nil {
+		return false, err
+	}
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// runCommand applies drop, create and rename commands from the source to the table, according to the commands option.
+// a rename renames our table to the table part of the new namespace
+func (r *Rethinkdb) runCommand(msg *message.Msg) error {
+	c, arg, ok := msg.Command()
+	if !ok || c == message.Flush || c == message.CopyComplete { // applyOp has already written the batch
+		return nil
+	}
+
+	switch r.commands {
+	case commandsIgnore:
+		return nil
+	case commandsWarn:
+		r.pipe.Err <- commandWarning(r.path, c, arg)
+		return nil
+	}
+
+	var err error
+	switch c {
+	case message.Drop:
+		_, err = gorethink.Db(r.database).TableDrop(r.table).RunWrite(r.client)
+	case message.Create:
+		_, err = gorethink.Db(r.database).TableCreate(r.table).RunWrite(r.client)
+	case message.Rename:
+		to, ok := arg.(string)
+		if !ok {
+			return fmt.Errorf("malformed rename (%v)", arg)
+		}
+		fields := strings.SplitN(to, ".", 2)
+		table := fields[len(fields)-1]
+		_, err = gorethink.Db(r.database).Table(r.table).Config().Update(map[string]interface{}{"name": table}).RunWrite(r.client)
+		if err == nil {
+			r.table = table
+		}
+	}
+	return err
+}
+
 // handleresponse takes the rethink response and turn it into something we can consume elsewhere
 func (r *Rethinkdb) handleResponse(resp *gorethink.WriteResponse) error {
 	if resp.Errors != 0 {
@@ -135,3 +563,26 @@ func (r *Rethinkdb) handleResponse(resp *gorethink.WriteResponse) error {
 	}
 	return nil
 }
+
+// RethinkdbConfig provides configuration options for a rethinkdb adaptor
+type RethinkdbConfig struct {
+	URI       string `json:"uri"`       // the rethinkdb uri, ie. rethinkdb://:authkey@localhost:28015/database
+	Namespace string `json:"namespace"` // the database and table, as database.table
+	Debug     bool   `json:"debug"`     // debug mode
+	Commands  string `json:"commands"`  // what a sink does with commands from the source, "apply", "warn" or "ignore"
+
+	// Setup is what the sink does to the table when it starts.  "create" creates the database and table if they don't exist,
+	// "truncate" creates them too, and deletes everything in the table.  by default, the table is left alone
+	Setup string `json:"setup"`
+
+	// BatchSize is the number of documents written in one insert, it defaults to 500
+	BatchSize int `json:"batch_size"`
+
+	// Since is a secondary index of a source's table whose values only ever go up, like an updated_at timestamp.
+	// with a checkpoint, a restarted source only reads the documents from the last value it saw onwards, instead of the whole table.
+	// documents without a value for the index are never read
+	Since string `json:"since"`
+
+	// Checkpoint is a file where the source saves the largest value of the since index that the sinks have processed
+	Checkpoint string `json:"checkpoint"`
+}
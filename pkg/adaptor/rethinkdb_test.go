@@ -0,0 +1,188 @@
+package adaptor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestNewRethinkdb(t *testing.T) {
+	data := []struct {
+		extra    Config
+		database string
+		table    string
+		err      bool
+	}{
+		{Config{"uri": "rethinkdb://localhost:28015", "namespace": "blog.posts"}, "blog", "posts", false},
+		{Config{"uri": "rethinkdb://localhost:28015/blog", "namespace": "posts"}, "blog", "posts", false},
+		{Config{"uri": "rethinkdb://localhost:28015/blog", "namespace": "other.posts"}, "other", "posts", false},
+		{Config{"uri": "rethinkdb://localhost:28015", "namespace": "posts"}, "", "", true},
+		{Config{"uri": "rethinkdb://localhost:28015", "namespace": "blog.posts", "setup": "drop"}, "", "", true},
+	}
+
+	for _, v := range data {
+		a, err := NewRethinkdb(pipe.NewPipe(nil, "some name"), "a/b/c", v.extra)
+		if (err != nil) != v.err {
+			t.Errorf("%v: expected error: %t, got: %v", v.extra, v.err, err)
+			continue
+		}
+		if v.err {
+			continue
+		}
+		r := a.(*Rethinkdb)
+		if r.database != v.database || r.table != v.table {
+			t.Errorf("%v: expected: %s.%s, got: %s.%s", v.extra, v.database, v.table, r.database, r.table)
+		}
+	}
+}
+
+func TestRethinkChangeMessage(t *testing.T) {
+	data := []struct {
+		change rethinkChange
+		op     message.OpType
+		doc    bson.M
+	}{
+		{rethinkChange{NewVal: bson.M{"id": "1", "a": 1}}, message.Insert, bson.M{"id": "1", "a": 1}},
+		{rethinkChange{NewVal: bson.M{"id": "1", "a": 2}, OldVal: bson.M{"id": "1", "a": 1}}, message.Update, bson.M{"id": "1", "a": 2}},
+		{rethinkChange{OldVal: bson.M{"id": "1", "a": 2}}, message.Delete, bson.M{"id": "1", "a": 2}},
+	}
+
+	for _, v := range data {
+		msg := v.change.message()
+		if msg.Op != v.op || !reflect.DeepEqual(msg.Document(), v.doc) {
+			t.Errorf("%+v: expected: %s %v, got: %s %v", v.change, v.op, v.doc, msg.Op, msg.Document())
+		}
+	}
+
+	if msg := (rethinkChange{State: "initializing"}).message(); msg != nil {
+		t.Errorf("expected no message for a state change, got: %v", msg)
+	}
+}
+
+func TestRethinkAdd(t *testing.T) {
+	a, err := NewRethinkdb(pipe.NewPipe(nil, "some name"), "a/b/c", Config{"uri": "rethinkdb://localhost:28015", "namespace": "blog.posts"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := a.(*Rethinkdb)
+
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	first := message.NewMsg(message.Insert, bson.M{"_id": id, "title": "first"})
+	r.add(first)
+	r.add(message.NewMsg(message.Update, bson.M{"_id": id, "title": "second"}))
+	r.add(message.NewMsg(message.Insert, bson.M{"_id": 2, "title": "other"}))
+	r.add(message.NewMsg(message.Insert, bson.M{"_id": bson.M{"a": 1, "b": 2}, "title": "compound"}))
+	r.add(message.NewMsg(message.Update, bson.M{"_id": bson.M{"b": 2, "a": 1}, "title": "compound again"}))
+	r.add(message.NewMsg(message.Insert, bson.M{"_id": []interface{}{1, 2}, "title": "array"}))
+
+	expected := []interface{}{
+		bson.M{"_id": id, "id": "546656989330a846dc7ce327", "title": "second"},
+		bson.M{"_id": 2, "id": 2, "title": "other"},
+		bson.M{"_id": bson.M{"b": 2, "a": 1}, "id": bson.M{"b": 2, "a": 1}, "title": "compound again"},
+		bson.M{"_id": []interface{}{1, 2}, "id": []interface{}{1, 2}, "title": "array"},
+	}
+	if !reflect.DeepEqual(r.batch, expected) {
+		t.Errorf("expected: %v, got: %v", expected, r.batch)
+	}
+
+	// the other sinks see the document as it was sent
+	if doc := first.Document(); !reflect.DeepEqual(doc, bson.M{"_id": id, "title": "first"}) {
+		t.Errorf("expected the message's document to be left alone, got: %v", doc)
+	}
+}
+
+func TestRethinkMarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "checkpoint.json")
+
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "sink")
+	a, err := NewRethinkdb(source, "a/b/c", Config{"uri": "rethinkdb://localhost:28015", "namespace": "blog.posts", "since": "updated", "checkpoint": filename})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := a.(*Rethinkdb)
+
+	saved := func() (v interface{}) {
+		c, err := newCheckpoint(filename)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		c.Get("since", &v)
+		return v
+	}
+
+	flushes := make(chan *message.Msg, 1)
+	go func() {
+		flushes <- <-sink.In
+	}()
+	r.track(bson.M{"id": "1", "updated": 10})
+	r.track(bson.M{"id": "2", "updated": 5}) // older than what we've sent
+	r.mark()
+	flush := <-flushes
+	r.mark() // nothing newer has been sent
+	if len(r.marks) != 1 {
+		t.Errorf("expected 1 mark, got %d", len(r.marks))
+	}
+
+	r.confirmMarks(true)
+	if v := saved(); v != nil {
+		t.Errorf("expected nothing to be checkpointed before the sinks have the flush, got %v", v)
+	}
+	flush.Receipt.Processed()
+	r.confirmMarks(true)
+	if v := saved(); !reflect.DeepEqual(v, map[string]interface{}{"$numberInt": "10"}) {
+		t.Errorf("expected 10, got %v", v)
+	}
+}
+
+func TestRethinkInitialRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := pipe.NewPipe(nil, "source")
+	sink := pipe.NewPipe(source, "sink")
+	go func() {
+		for range source.Event {
+		}
+	}()
+	flushes := make(chan *message.Msg, 10)
+	go func() {
+		for msg := range sink.In {
+			if msg.IsCommand(message.Flush) {
+				flushes <- msg
+			}
+		}
+	}()
+	a, err := NewRethinkdb(source, "a/b/c", Config{"uri": "rethinkdb://localhost:28015", "namespace": "blog.posts", "since": "updated", "checkpoint": filepath.Join(dir, "checkpoint.json")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := a.(*Rethinkdb)
+
+	// the initial read isn't in order, so nothing is marked until it's over
+	r.apply(rethinkChange{NewVal: bson.M{"id": "1", "updated": 10}})
+	r.apply(rethinkChange{NewVal: bson.M{"id": "2", "updated": 5}})
+	if len(r.marks) != 0 {
+		t.Errorf("expected nothing to be marked during the initial read, got %d marks", len(r.marks))
+	}
+
+	r.apply(rethinkChange{State: "ready"})
+	<-flushes
+	if len(r.marks) != 1 || r.marks[0].value != 10 {
+		t.Errorf("expected 10 to be marked once the initial read was over, got %v", r.marks)
+	}
+}
@@ -0,0 +1,477 @@
+package adaptor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/compose/transporter/pkg/extjson"
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	Register("s3", NewS3)
+}
+
+// S3 is an adaptor that archives messages to s3, or any service that speaks it's api, ie. minio, and restores them.
+// as a sink, the documents, or their change-event envelopes, are written as newline delimited json objects, optionally
+// gzipped, under a key prefix built from the namespace and the date.  an object is written once it's big enough, or old
+// enough.  flushes don't write the objects, instead the flush's receipt is held until the objects that were open when it
+// arrived have been written, so a source's checkpoint waits for it's messages to be in s3.  sources that wait for a
+// flush before reading more can't wait for max_age, so objects holding a receipt are written once it's been held for
+// checkpointInterval.
+// as a source, the objects under the prefix are read back in the order they were written
+type S3 struct {
+	bucket    string
+	namespace string
+	prefix    *template.Template // where objects are written, under the bucket
+	gzip      bool
+	envelope  bool // write and read change-event envelopes, rather than bare documents
+	mode      extjson.Mode
+	maxSize   int
+	maxAge    time.Duration
+
+	store   s3Store
+	objects map[string]*s3Object // the objects being written, by prefix
+	failed  []*s3Object          // objects that couldn't be written, they're retried in order
+	lock    sync.Mutex
+
+	pipe *pipe.Pipe
+	path string
+}
+
+// s3Store is the part of s3 that we use
+type s3Store interface {
+	put(key string, body []byte, contentEncoding string) error
+	list(prefix string) ([]string, error)
+	get(key string) (io.ReadCloser, error)
+}
+
+// s3Object is an object that's being written
+type s3Object struct {
+	buf      bytes.Buffer
+	gz       *gzip.Writer
+	count    int
+	opened   time.Time
+	receipts []*message.Receipt // the receipts of flushes that are waiting for the object to be written
+	held     time.Time          // when the first of the receipts arrived
+
+	key      string // set once the object is finished
+	encoding string
+}
+
+// s3PrefixData is what the prefix template is filled in with, the date is when the object was started, in utc
+type s3PrefixData struct {
+	Namespace string
+	Year      string
+	Month     string
+	Day       string
+	Hour      string
+}
+
+// NewS3 creates a new S3 adaptor
+func NewS3(p *pipe.Pipe, path string, extra Config) (StopStartListener, error) {
+	var (
+		conf S3Config
+		err  error
+	)
+	if err = extra.Construct(&conf); err != nil {
+		return nil, NewError(CRITICAL, path, fmt.Sprintf("Can't create constructor (%s)", err.Error()), nil)
+	}
+
+	s := &S3{
+		bucket:    conf.Bucket,
+		namespace: conf.Namespace,
+		gzip:      conf.Gzip,
+		mode:      extjson.Canonical,
+		maxSize:   conf.MaxSize,
+		maxAge:    5 * time.Minute,
+		objects:   map[string]*s3Object{},
+		pipe:      p,
+		path:      path,
+	}
+	if s.bucket == "" {
+		return s, NewError(CRITICAL, path, "S3 error (no bucket)", nil)
+	}
+	if conf.Relaxed {
+		s.mode = extjson.Relaxed
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = 64 << 20
+	}
+	if conf.MaxAge != "" {
+		if s.maxAge, err = time.ParseDuration(conf.MaxAge); err != nil || s.maxAge <= 0 {
+			return s, NewError(CRITICAL, path, fmt.Sprintf("S3 error (malformed max_age %s)", conf.MaxAge), nil)
+		}
+	}
+	if s.envelope, err = formatOption(conf.Format); err != nil {
+		return s, NewError(CRITICAL, path, fmt.Sprintf("S3 error (%s)", err.Error()), nil)
+	}
+
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = "{{.Namespace}}/{{.Year}}/{{.Month}}/{{.Day}}/"
+	}
+	if s.prefix, err = template.New("prefix").Option("missingkey=zero").Parse(prefix); err != nil {
+		return s, NewError(CRITICAL, path, fmt.Sprintf("S3 error (malformed prefix %s)", err.Error()), nil)
+	}
+
+	endpoint := conf.Endpoint
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	creds := credentials.NewStaticV4(conf.AccessKey, conf.SecretKey, "")
+	if conf.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}, &credentials.IAM{}})
+	}
+	client, err := minio.New(endpoint, &minio.Options{Creds: creds, Secure: !conf.Insecure, Region: conf.Region})
+	if err != nil {
+		return s, NewError(CRITICAL, path, fmt.Sprintf("S3 error (%s)", err.Error()), nil)
+	}
+	s.store = &minioStore{client: client, bucket: s.bucket}
+
+	return s, nil
+}
+
+// Start the adaptor as a source.  the objects under the literal part of the prefix, up to the first template action,
+// are read in the order of their keys, which is the order they were written in
+func (s *S3) Start() (err error) {
+	defer func() {
+		s.pipe.Stop()
+	}()
+
+	prefix := s.prefix.Root.String()
+	if i := strings.Index(prefix, "{{"); i >= 0 {
+		prefix = prefix[:i]
+	}
+	keys, err := s.store.list(prefix)
+	if err != nil {
+		s.pipe.Err <- NewError(CRITICAL, s.path, fmt.Sprintf("S3 error (can't list %s, %s)", prefix, err.Error()), nil)
+		return err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if s.pipe.Stopped {
+			return nil
+		}
+		if !strings.HasSuffix(key, ".ndjson") && !strings.HasSuffix(key, ".ndjson.gz") {
+			continue
+		}
+		if err = s.readObject(key); err != nil {
+			s.pipe.Err <- NewError(CRITICAL, s.path, fmt.Sprintf("S3 error (can't read %s, %s)", key, err.Error()), nil)
+			return err
+		}
+	}
+	return nil
+}
+
+// readObject sends the documents in an object down the pipeline
+func (s *S3) readObject(key string) error {
+	body, err := s.store.get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if strings.HasSuffix(key, ".gz") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	dec := extjson.NewDecoder(r)
+	for line := 1; ; line++ {
+		doc, err := dec.Decode()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("document %d, %s", line, err.Error())
+		}
+
+		msg := message.NewMsg(message.Insert, doc)
+		if s.envelope {
+			e, err := message.EnvelopeFromDocument(doc)
+			if err != nil {
+				s.pipe.Err <- NewError(ERROR, s.path, fmt.Sprintf("S3 error (can't read envelope %d in %s, %s)", line, key, err.Error()), doc)
+				continue
+			}
+			msg = e.Msg()
+		}
+		meta := bson.M{"object": key, "line": line}
+		if ns := msg.Namespace(); ns != "" {
+			meta["namespace"] = ns
+		} else if s.namespace != "" {
+			meta["namespace"] = s.namespace
+		}
+		msg.Meta = meta
+		s.pipe.Send(msg)
+	}
+}
+
+// Listen starts the listener.  objects that are older than max_age, or that have held a flush for checkpointInterval,
+// are written in the background, even if no more messages arrive
+func (s *S3) Listen() error {
+	done := make(chan struct{})
+	go func() {
+		interval := s.maxAge / 4
+		if interval > checkpointInterval/4 {
+			interval = checkpointInterval / 4
+		}
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.writeObjects(false)
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		s.writeObjects(true)
+	}()
+
+	return s.pipe.Listen(s.applyOp)
+}
+
+// Stop the adaptor
+func (s *S3) Stop() error {
+	s.pipe.Stop()
+	return nil
+}
+
+// applyOp adds the message to the object for it's prefix, which is written once it's big enough.  a flush is held
+// until the objects with the messages before it are written, and the end of a copy writes every object.
+// commands are only written as envelopes
+func (s *S3) applyOp(msg *message.Msg) (*message.Msg, error) {
+	if msg.Op == message.Command {
+		if msg.IsCommand(message.Flush) {
+			s.holdReceipt(msg.Receipt)
+			return msg, nil
+		} else if msg.IsCommand(message.CopyComplete) {
+			s.holdReceipt(msg.Receipt)
+			s.writeObjects(true)
+			return msg, nil
+		} else if !s.envelope {
+			return msg, nil
+		}
+	}
+
+	now := time.Now().UTC()
+	prefix, err := s.objectPrefix(msg, now)
+	if err != nil {
+		s.pipe.Err <- NewError(ERROR, s.path, fmt.Sprintf("S3 error (can't build prefix %s)", err.Error()), msg.Document())
+		return msg, nil
+	}
+
+	doc := msg.Document()
+	if s.envelope {
+		e := message.NewEnvelope(msg)
+		if e.Namespace == "" {
+			e.Namespace = s.namespace
+		}
+		doc = e.Document()
+	}
+	line, err := extjson.Marshal(doc, s.mode)
+	if err != nil {
+		s.pipe.Err <- NewError(ERROR, s.path, fmt.Sprintf("S3 error (%s)", err.Error()), msg.Document())
+		return msg, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o, ok := s.objects[prefix]
+	if !ok {
+		o = &s3Object{opened: now}
+		if s.gzip {
+			o.gz = gzip.NewWriter(&o.buf)
+		}
+		s.objects[prefix] = o
+	}
+	o.write(append(line, '\n'))
+	if o.buf.Len() >= s.maxSize {
+		s.writeObject(prefix, o)
+	}
+	return msg, nil
+}
+
+// objectPrefix fills in the prefix template for a message
+func (s *S3) objectPrefix(msg *message.Msg, now time.Time) (string, error) {
+	data := s3PrefixData{
+		Namespace: msg.Namespace(),
+		Year:      now.Format("2006"),
+		Month:     now.Format("01"),
+		Day:       now.Format("02"),
+		Hour:      now.Format("15"),
+	}
+	if data.Namespace == "" {
+		data.Namespace = s.namespace
+	}
+	var buf bytes.Buffer
+	if err := s.prefix.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// holdReceipt keeps a flush's receipt with every object that hasn't been written yet, so that the flush isn't
+// delivered until they have been
+func (s *S3) holdReceipt(r *message.Receipt) {
+	if r == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r.Add(len(s.objects) + len(s.failed))
+	for _, o := range s.objects {
+		if len(o.receipts) == 0 {
+			o.held = time.Now()
+		}
+		o.receipts = append(o.receipts, r)
+	}
+	for _, o := range s.failed {
+		o.receipts = append(o.receipts, r)
+	}
+}
+
+// writeObjects retries the objects that couldn't be written, and writes the objects that are older than max_age, or
+// have held a flush for checkpointInterval, or all of them
+func (s *S3) writeObjects(all bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	failed := s.failed
+	s.failed = nil
+	for _, o := range failed {
+		s.putObject(o)
+	}
+	for prefix, o := range s.objects {
+		if all || time.Since(o.opened) >= s.maxAge || (len(o.receipts) > 0 && time.Since(o.held) >= checkpointInterval) {
+			s.writeObject(prefix, o)
+		}
+	}
+}
+
+// writeObject finishes an object, and writes it to s3 with a key that sorts after the objects written before it.
+// the caller holds the lock
+func (s *S3) writeObject(prefix string, o *s3Object) {
+	delete(s.objects, prefix)
+
+	o.key = prefix + bson.NewObjectId().Hex() + ".ndjson"
+	if o.gz != nil {
+		o.gz.Close()
+		o.key, o.encoding = o.key+".gz", "gzip"
+	}
+	s.putObject(o)
+}
+
+// putObject writes a finished object to s3, and lets the flushes that were waiting for it know.  if the write fails,
+// the object is kept, with it's key, and retried the next time objects are written.  the caller holds the lock
+func (s *S3) putObject(o *s3Object) {
+	if err := s.store.put(o.key, o.buf.Bytes(), o.encoding); err != nil {
+		s.pipe.Err <- NewError(ERROR, s.path, fmt.Sprintf("S3 error (can't write %s, %s)", o.key, err.Error()), bson.M{"key": o.key, "documents": o.count})
+		s.failed = append(s.failed, o)
+		return
+	}
+	for _, r := range o.receipts {
+		r.Processed()
+	}
+	o.receipts = nil
+}
+
+// write adds a line to the object
+func (o *s3Object) write(line []byte) {
+	if o.gz != nil {
+		o.gz.Write(line)
+	} else {
+		o.buf.Write(line)
+	}
+	o.count++
+}
+
+// minioStore talks to s3 with the minio client
+type minioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func (m *minioStore) put(key string, body []byte, contentEncoding string) error {
+	_, err := m.client.PutObject(context.Background(), m.bucket, key, bytes.NewReader(body), int64(len(body)),
+		minio.PutObjectOptions{ContentType: "application/x-ndjson", ContentEncoding: contentEncoding})
+	return err
+}
+
+func (m *minioStore) list(prefix string) ([]string, error) {
+	var keys []string
+	for obj := range m.client.ListObjects(context.Background(), m.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (m *minioStore) get(key string) (io.ReadCloser, error) {
+	return m.client.GetObject(context.Background(), m.bucket, key, minio.GetObjectOptions{})
+}
+
+// S3Config provides configuration options for an s3 adaptor
+type S3Config struct {
+	Namespace string `json:"namespace"` // the namespace of messages from sources that don't say which namespace they came from
+	Debug     bool   `json:"debug"`     // debug mode
+
+	// Endpoint is the s3 service, it defaults to s3.amazonaws.com.  for minio, it's ie. localhost:9000, with
+	// Insecure to connect over http rather than https
+	Endpoint string `json:"endpoint"`
+	Insecure bool   `json:"insecure"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+
+	// AccessKey and SecretKey are the credentials.  without them, the credentials are taken from the
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or MINIO_ACCESS_KEY and MINIO_SECRET_KEY environment variables,
+	// or from the instance's iam role
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+
+	// Prefix is a template for the prefix of the objects' keys, filled in with the message's .Namespace, and the .Year,
+	// .Month, .Day and .Hour the object was started.  it defaults to "{{.Namespace}}/{{.Year}}/{{.Month}}/{{.Day}}/".
+	// a source reads the objects under the part of the prefix before the first {{
+	Prefix string `json:"prefix"`
+
+	// Gzip compresses the objects
+	Gzip bool `json:"gzip"`
+
+	// an object is written once it's MaxSize bytes (64MB by default), or MaxAge old (5m by default).  a source's
+	// flushes wait for it's messages to be written, so an object is also written once it's held a flush for a second
+	MaxSize int    `json:"max_size"`
+	MaxAge  string `json:"max_age"`
+
+	// Format is either "document" (the default), where each line is a document, or "envelope", where each line is a
+	// change-event envelope describing the operation, as well as the document before and after it
+	Format string `json:"format"`
+
+	// documents are written as canonical extended json, which keeps all of their bson types.
+	// Relaxed writes the more readable relaxed form instead
+	Relaxed bool `json:"relaxed"`
+}
@@ -0,0 +1,277 @@
+package adaptor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/compose/transporter/pkg/message"
+	"github.com/compose/transporter/pkg/pipe"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStore keeps objects in memory, puts fail while err is set
+type memoryStore struct {
+	objects   map[string][]byte
+	encodings map[string]string
+	err       error
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string][]byte{}, encodings: map[string]string{}}
+}
+
+func (m *memoryStore) put(key string, body []byte, contentEncoding string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.objects[key] = append([]byte(nil), body...)
+	m.encodings[key] = contentEncoding
+	return nil
+}
+
+func (m *memoryStore) list(prefix string) ([]string, error) {
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *memoryStore) get(key string) (io.ReadCloser, error) {
+	body, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("no such key")
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (m *memoryStore) keys() []string {
+	keys, _ := m.list("")
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestS3(t *testing.T, p *pipe.Pipe, store *memoryStore, conf Config) *S3 {
+	conf["bucket"] = "archive"
+	a, err := NewS3(p, "a/b/c", conf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := a.(*S3)
+	s.store = store
+	return s
+}
+
+func TestS3Objects(t *testing.T) {
+	store := newMemoryStore()
+	s := newTestS3(t, pipe.NewPipe(nil, "some name"), store, Config{"namespace": "blog.posts", "max_size": 60, "relaxed": true})
+
+	for i := 0; i < 3; i++ {
+		s.applyOp(message.NewMsg(message.Insert, bson.M{"_id": i, "title": "hello world"}))
+	}
+	users := message.NewMsg(message.Insert, bson.M{"_id": 1, "name": "alice"})
+	users.Meta = bson.M{"namespace": "blog.users"}
+	s.applyOp(users)
+	s.applyOp(message.NewCommandMsg(message.Drop, nil)) // only written as an envelope
+
+	// the first two posts fill an object
+	keys := store.keys()
+	if len(keys) != 1 {
+		t.Fatalf("expected an object to be written once it was big enough, got %v", keys)
+	}
+	date := time.Now().UTC().Format("2006/01/02")
+	if !strings.HasPrefix(keys[0], "blog.posts/"+date+"/") || !strings.HasSuffix(keys[0], ".ndjson") {
+		t.Errorf("unexpected key %s", keys[0])
+	}
+	if body := string(store.objects[keys[0]]); body != "{\"_id\":0,\"title\":\"hello world\"}\n{\"_id\":1,\"title\":\"hello world\"}\n" {
+		t.Errorf("unexpected object %q", body)
+	}
+
+	// a flush waits for the open objects, rather than writing them
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	s.applyOp(flush)
+	flush.Receipt.Processed() // as the pipe would
+	if keys = store.keys(); len(keys) != 1 || flush.Receipt.Delivered() {
+		t.Fatalf("expected the flush to wait for the objects to be written, got %v", keys)
+	}
+
+	s.writeObjects(true)
+	keys = store.keys()
+	if len(keys) != 3 || len(s.objects) != 0 {
+		t.Fatalf("expected every object to be written, got %v", keys)
+	}
+	if !flush.Receipt.Delivered() {
+		t.Errorf("expected the flush to be delivered once the objects were written")
+	}
+	if !strings.HasPrefix(keys[2], "blog.users/"+date+"/") || string(store.objects[keys[2]]) != "{\"_id\":1,\"name\":\"alice\"}\n" {
+		t.Errorf("unexpected object %s %q", keys[2], store.objects[keys[2]])
+	}
+	if keys[1] <= keys[0] {
+		t.Errorf("expected the keys to sort in the order they were written, got %v", keys)
+	}
+}
+
+func TestS3RoundTrip(t *testing.T) {
+	store := newMemoryStore()
+	sink := newTestS3(t, pipe.NewPipe(nil, "some name"), store, Config{"namespace": "blog.posts", "prefix": "backups/{{.Namespace}}/", "gzip": true, "format": "envelope"})
+
+	id := bson.ObjectIdHex("546656989330a846dc7ce327")
+	update := message.NewMsg(message.Update, bson.M{"_id": id, "views": int64(10)})
+	update.Before = bson.M{"_id": id, "views": int64(9)}
+	in := []*message.Msg{
+		message.NewMsg(message.Insert, bson.M{"_id": id, "views": int64(9)}),
+		update,
+		message.NewMsg(message.Delete, bson.M{"_id": id}),
+	}
+	for _, msg := range in[:2] {
+		sink.applyOp(msg)
+	}
+	sink.writeObjects(true)
+	sink.applyOp(in[2])
+	sink.writeObjects(true)
+
+	keys := store.keys()
+	if len(keys) != 2 || store.encodings[keys[0]] != "gzip" || !strings.HasSuffix(keys[0], ".ndjson.gz") {
+		t.Fatalf("expected two gzipped objects, got %v %v", keys, store.encodings)
+	}
+	store.objects["backups/README"] = []byte("not an archive")
+
+	// read them back
+	var (
+		source = pipe.NewPipe(nil, "source")
+		out    = pipe.NewPipe(source, "sink")
+		mu     sync.Mutex
+		msgs   []*message.Msg
+	)
+	go func() {
+		for range source.Err {
+		}
+	}()
+	go out.Listen(func(msg *message.Msg) (*message.Msg, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		msgs = append(msgs, msg)
+		return msg, nil
+	})
+	defer out.Stop()
+
+	src := newTestS3(t, source, store, Config{"prefix": "backups/{{.Namespace}}/", "format": "envelope"})
+	if err := src.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(msgs)
+		mu.Unlock()
+		if n == len(in) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages, got %d", len(in), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, v := range in {
+		msg := msgs[i]
+		if msg.Op != v.Op || msg.ID != v.ID || !reflect.DeepEqual(msg.Document(), v.Document()) || msg.Namespace() != "blog.posts" {
+			t.Errorf("%d: expected %s %v, got %s %v (%v)", i, v.Op, v.Document(), msg.Op, msg.Document(), msg.Meta)
+		}
+	}
+	if !reflect.DeepEqual(msgs[1].Before, update.Before) {
+		t.Errorf("expected the update's before to be restored, got %v", msgs[1].Before)
+	}
+	if msgs[2].Meta["object"] != keys[1] || msgs[2].Meta["line"] != 1 {
+		t.Errorf("unexpected meta %v", msgs[2].Meta)
+	}
+}
+
+func TestS3Retry(t *testing.T) {
+	store := newMemoryStore()
+	p := pipe.NewPipe(nil, "some name")
+	errs := make(chan error, 10)
+	go func() {
+		for err := range p.Err {
+			errs <- err
+		}
+	}()
+	s := newTestS3(t, p, store, Config{"namespace": "blog.posts", "relaxed": true})
+
+	s.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 1}))
+	flush := message.NewCommandMsg(message.Flush, nil)
+	flush.Receipt = message.NewReceipt()
+	s.applyOp(flush)
+	flush.Receipt.Processed()
+
+	store.err = fmt.Errorf("unavailable")
+	s.writeObjects(true)
+	select {
+	case err := <-errs:
+		if e, ok := err.(Error); !ok || e.Lvl != ERROR {
+			t.Errorf("expected an error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected an error for the failed write")
+	}
+	if len(store.keys()) != 0 || flush.Receipt.Delivered() {
+		t.Fatalf("expected nothing to be written")
+	}
+
+	// the object is kept, and written once s3 is back, ahead of the newer objects
+	s.applyOp(message.NewMsg(message.Insert, bson.M{"_id": 2}))
+	store.err = nil
+	s.writeObjects(true)
+	keys := store.keys()
+	if len(keys) != 2 || string(store.objects[keys[0]]) != "{\"_id\":1}\n" || string(store.objects[keys[1]]) != "{\"_id\":2}\n" {
+		t.Errorf("expected both objects to be written in order, got %v %q", keys, store.objects)
+	}
+	if !flush.Receipt.Delivered() {
+		t.Errorf("expected the flush to be delivered once the object was written")
+	}
+}
+
+func TestS3BlockingSource(t *testing.T) {
+	store := newMemoryStore()
+	source := pipe.NewPipe(nil, "source")
+	sink := newTestS3(t, pipe.NewPipe(source, "sink"), store, Config{"namespace": "blog.posts", "relaxed": true})
+	go sink.Listen()
+	defer sink.Stop()
+
+	// a source that waits for each flush before reading more isn't held up for max_age
+	for i := 0; i < 2; i++ {
+		source.Send(message.NewMsg(message.Insert, bson.M{"_id": i}))
+		done := make(chan bool, 1)
+		go func() {
+			done <- waitForSinks(source)
+		}()
+		select {
+		case ok := <-done:
+			if !ok {
+				t.Fatalf("expected the flush to be delivered")
+			}
+		case <-time.After(3 * checkpointInterval):
+			t.Fatalf("expected the flush to be delivered within %s", 3*checkpointInterval)
+		}
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if keys := store.keys(); len(keys) != 2 {
+		t.Errorf("expected an object for each flush, got %v", keys)
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"io/ioutil"
 	"time"
 
-	"github.com/compose/mejson"
+	"github.com/compose/transporter/pkg/extjson"
 	"github.com/compose/transporter/pkg/message"
 	"github.com/compose/transporter/pkg/pipe"
 	"github.com/robertkrimen/otto"
+	"gopkg.in/mgo.v2/bson"
 	_ "github.com/robertkrimen/otto/underscore" // enable underscore
 )
 
@@ -53,7 +54,7 @@ func NewTransformer(p *pipe.Pipe, path string, extra Config) (StopStartListener,
 }
 
 // Listen starts the transformer's listener, reads each message from the incoming channel
-// transformers it into mejson, and then uses the supplied javascript module.exports function
+// transformers it into relaxed extended json, and then uses the supplied javascript module.exports function
 // to transform the document.  The document is then emited to this adaptor's children
 func (t *Transformer) Listen() (err error) {
 	t.vm = otto.New()
@@ -105,7 +106,7 @@ func (t *Transformer) transformOne(msg *message.Msg) (*message.Msg, error) {
 
 	now := time.Now().Nanosecond()
 
-	if doc, err = mejson.Marshal(msg.Document()); err != nil {
+	if doc, err = extjson.Encode(msg.Document(), extjson.Relaxed); err != nil {
 		t.pipe.Err <- t.transformerError(ERROR, err, msg)
 		return msg, nil
 	}
@@ -132,12 +133,12 @@ func (t *Transformer) transformOne(msg *message.Msg) (*message.Msg, error) {
 
 	switch r := result.(type) {
 	case map[string]interface{}:
-		doc, err := mejson.Unmarshal(r)
+		doc, err := extjson.Decode(r)
 		if err != nil {
 			t.pipe.Err <- t.transformerError(ERROR, err, msg)
 			return msg, nil
 		}
-		msg.SetDocument(doc)
+		msg.SetDocument(restoreNumbers(doc, msg.Document()).(bson.M))
 	default:
 		if t.debug {
 			fmt.Println("transformer skipping doc")
@@ -152,6 +153,50 @@ func (t *Transformer) transformOne(msg *message.Msg) (*message.Msg, error) {
 	return msg, nil
 }
 
+// restoreNumbers puts back the numeric types that were lost in the vm.  javascript only has one kind of number, so
+// a number in the transformed document takes on the type of the number it replaced in the original document,
+// as long as it can do so without losing anything
+func restoreNumbers(out, orig interface{}) interface{} {
+	switch o := out.(type) {
+	case bson.M:
+		if origDoc, ok := orig.(bson.M); ok {
+			for k, v := range o {
+				o[k] = restoreNumbers(v, origDoc[k])
+			}
+		}
+	case []interface{}:
+		if origList, ok := orig.([]interface{}); ok {
+			for i := range o {
+				if i < len(origList) {
+					o[i] = restoreNumbers(o[i], origList[i])
+				}
+			}
+		}
+	case int, int64, float64:
+		f, ok := toFloat(out)
+		if !ok {
+			break
+		}
+		switch orig.(type) {
+		case float64:
+			return f
+		case int:
+			if f == float64(int(f)) {
+				return int(f)
+			}
+		case int32:
+			if f == float64(int32(f)) {
+				return int32(f)
+			}
+		case int64:
+			if f == float64(int64(f)) {
+				return int64(f)
+			}
+		}
+	}
+	return out
+}
+
 func (t *Transformer) transformerError(lvl ErrorLevel, err error, msg *message.Msg) error {
 	if e, ok := err.(*otto.Error); ok {
 		return NewError(lvl, t.path, fmt.Sprintf("Transformer error (%s)", e.String()), msg.Document())
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	// "time"
 
+	"github.com/compose/transporter/pkg/extjson"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -91,6 +92,44 @@ func (e *MetricsEvent) String() string {
 	return msg
 }
 
+// SnapshotEvent is emitted by a source once it has finished copying the existing data,
+// and marks the boundary between the copy and the tail
+type SnapshotEvent struct {
+	Ts   int64  `json:"ts"`
+	Kind string `json:"name"`
+	Path string `json:"path"`
+
+	// Records is the number of documents that were copied
+	Records int `json:"records"`
+
+	// Position is the source's position (ie. the oplog timestamp) when the copy finished.
+	// the format depends on the source
+	Position string `json:"position,omitempty"`
+}
+
+// NewSnapshotEvent creates a new snapshot event
+func NewSnapshotEvent(ts int64, path string, records int, position string) *SnapshotEvent {
+	e := &SnapshotEvent{
+		Ts:       ts,
+		Kind:     "snapshot",
+		Path:     path,
+		Records:  records,
+		Position: position,
+	}
+	return e
+}
+
+// Emit prepares the event to be emitted and marshalls the event into an json
+func (e *SnapshotEvent) Emit() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func (e *SnapshotEvent) String() string {
+	msg := fmt.Sprintf("%s %s", e.Kind, e.Path)
+	msg += fmt.Sprintf(" records: %d, position: %s", e.Records, e.Position)
+	return msg
+}
+
 // ErrorEvent is an event that indicates an error occured
 // during the processing of a pipeline
 type ErrorEvent struct {
@@ -117,9 +156,23 @@ func NewErrorEvent(ts int64, path string, record bson.M, message string) *ErrorE
 	return e
 }
 
-// Emit prepares the event to be emitted and marshalls the event into an json
+// Emit prepares the event to be emitted and marshalls the event into an json.
+// the record is marshalled as relaxed extended json so that it's bson types aren't lost
 func (e *ErrorEvent) Emit() ([]byte, error) {
-	return json.Marshal(e)
+	var (
+		record []byte
+		err    error
+	)
+	if e.Record != nil {
+		if record, err = extjson.Marshal(e.Record, extjson.Relaxed); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(struct {
+		*ErrorEvent
+		Record json.RawMessage `json:"record,omitempty"`
+	}{e, record})
 }
 
 // String
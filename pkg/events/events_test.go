@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestEvent(t *testing.T) {
@@ -24,6 +26,10 @@ func TestEvent(t *testing.T) {
 			NewMetricsEvent(12345, "nick/yay", 1),
 			[]byte("{\"ts\":12345,\"name\":\"metrics\",\"path\":\"nick/yay\",\"records\":1}"),
 		},
+		{
+			NewSnapshotEvent(12345, "nick", 10, "oplog:6789"),
+			[]byte("{\"ts\":12345,\"name\":\"snapshot\",\"path\":\"nick\",\"records\":10,\"position\":\"oplog:6789\"}"),
+		},
 	}
 
 	for _, d := range data {
@@ -38,3 +44,31 @@ func TestEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorEventEmit(t *testing.T) {
+	data := []struct {
+		in   Event
+		want string
+	}{
+		{
+			NewErrorEvent(12345, "nick/yay", nil, "boom"),
+			`{"ts":12345,"name":"error","path":"nick/yay","message":"boom"}`,
+		},
+		{
+			NewErrorEvent(12345, "nick/yay", bson.M{"_id": bson.ObjectIdHex("546656989330a846dc7ce327"), "count": int64(2)}, "boom"),
+			`{"ts":12345,"name":"error","path":"nick/yay","message":"boom","record":{"_id":{"$oid":"546656989330a846dc7ce327"},"count":2}}`,
+		},
+	}
+
+	for _, d := range data {
+		ba, err := d.in.Emit()
+		if err != nil {
+			t.Errorf("got error: %s", err)
+			t.FailNow()
+		}
+
+		if string(ba) != d.want {
+			t.Errorf("wanted: %s, got: %s", d.want, ba)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package extjson
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// decodeValue converts a value decoded by encoding/json into bson types
+func decodeValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if special, ok, err := decodeSpecial(t); ok || err != nil {
+			return special, err
+		}
+		doc := make(bson.M, len(t))
+		for k, elem := range t {
+			val, err := decodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			doc[k] = val
+		}
+		return doc, nil
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, elem := range t {
+			val, err := decodeValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = val
+		}
+		return s, nil
+	case json.Number:
+		return decodeNumber(string(t)), nil
+	case float64:
+		// plain encoding/json output, we can only guess at the integers
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return decodeNumber(strconv.FormatFloat(t, 'f', -1, 64)), nil
+		}
+		return t, nil
+	default:
+		return v, nil
+	}
+}
+
+// decodeNumber follows the relaxed rules, integers are int (which mgo stores as an int32) if they fit,
+// otherwise int64.  anything with a decimal point or an exponent is a float64
+func decodeNumber(s string) interface{} {
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int(i)
+			}
+			return i
+		}
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// decodeSpecial recognizes the extended json representation of bson types, ok is false for plain documents
+func decodeSpecial(m map[string]interface{}) (v interface{}, ok bool, err error) {
+	switch len(m) {
+	case 1:
+		for k, val := range m {
+			return decodeSpecialOne(k, val)
+		}
+	case 2:
+		if code, ok := m["$code"].(string); ok {
+			if _, ok := m["$scope"]; ok {
+				scope, err := decodeValue(m["$scope"])
+				return bson.JavaScript{Code: code, Scope: scope}, true, err
+			}
+		}
+		if regex, ok := m["$regex"].(string); ok {
+			if options, ok := m["$options"].(string); ok {
+				return bson.RegEx{Pattern: regex, Options: options}, true, nil
+			}
+		}
+		if data, ok := m["$binary"].(string); ok {
+			if kind, ok := m["$type"].(string); ok {
+				return decodeBinary(data, kind)
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+func decodeSpecialOne(key string, val interface{}) (interface{}, bool, error) {
+	switch key {
+	case "$oid":
+		s, ok := val.(string)
+		if !ok || !bson.IsObjectIdHex(s) {
+			return nil, true, fmt.Errorf("invalid $oid %v", val)
+		}
+		return bson.ObjectIdHex(s), true, nil
+	case "$date":
+		return decodeDate(val)
+	case "$numberInt":
+		s, ok := val.(string)
+		i, err := strconv.ParseInt(s, 10, 32)
+		if !ok || err != nil {
+			return nil, true, fmt.Errorf("invalid $numberInt %v", val)
+		}
+		return int(i), true, nil
+	case "$numberLong":
+		s, ok := val.(string)
+		i, err := strconv.ParseInt(s, 10, 64)
+		if !ok || err != nil {
+			return nil, true, fmt.Errorf("invalid $numberLong %v", val)
+		}
+		return i, true, nil
+	case "$numberDouble":
+		s, ok := val.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $numberDouble %v", val)
+		}
+		switch s {
+		case "Infinity":
+			return math.Inf(1), true, nil
+		case "-Infinity":
+			return math.Inf(-1), true, nil
+		case "NaN":
+			return math.NaN(), true, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid $numberDouble %v", val)
+		}
+		return f, true, nil
+	case "$numberDecimal":
+		s, ok := val.(string)
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $numberDecimal %v", val)
+		}
+		d, err := bson.ParseDecimal128(s)
+		return d, true, err
+	case "$binary":
+		b, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		data, _ := b["base64"].(string)
+		kind, _ := b["subType"].(string)
+		return decodeBinary(data, kind)
+	case "$timestamp":
+		ts, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $timestamp %v", val)
+		}
+		t, terr := strconv.ParseUint(fmt.Sprint(ts["t"]), 10, 32)
+		i, ierr := strconv.ParseUint(fmt.Sprint(ts["i"]), 10, 32)
+		if terr != nil || ierr != nil {
+			return nil, true, fmt.Errorf("invalid $timestamp %v", val)
+		}
+		return bson.MongoTimestamp(int64(t)<<32 | int64(i)), true, nil
+	case "$regularExpression":
+		r, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $regularExpression %v", val)
+		}
+		pattern, _ := r["pattern"].(string)
+		options, _ := r["options"].(string)
+		return bson.RegEx{Pattern: pattern, Options: options}, true, nil
+	case "$symbol":
+		s, ok := val.(string)
+		return bson.Symbol(s), ok, nil
+	case "$code":
+		s, ok := val.(string)
+		return bson.JavaScript{Code: s}, ok, nil
+	case "$dbPointer":
+		p, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, true, fmt.Errorf("invalid $dbPointer %v", val)
+		}
+		ns, _ := p["$ref"].(string)
+		id, err := decodeValue(p["$id"])
+		oid, ok := id.(bson.ObjectId)
+		if err != nil || !ok {
+			return nil, true, fmt.Errorf("invalid $dbPointer %v", val)
+		}
+		return bson.DBPointer{Namespace: ns, Id: oid}, true, nil
+	case "$minKey":
+		return bson.MinKey, true, nil
+	case "$maxKey":
+		return bson.MaxKey, true, nil
+	case "$undefined":
+		return bson.Undefined, true, nil
+	}
+	return nil, false, nil
+}
+
+// decodeDate handles relaxed ISO-8601 strings, canonical {"$numberLong": ..} and legacy millisecond dates
+func decodeDate(val interface{}) (interface{}, bool, error) {
+	var ms int64
+	switch d := val.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, d)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid $date %v", val)
+		}
+		return t, true, nil
+	case map[string]interface{}:
+		s, _ := d["$numberLong"].(string)
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid $date %v", val)
+		}
+		ms = i
+	case json.Number:
+		i, err := d.Int64()
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid $date %v", val)
+		}
+		ms = i
+	case float64:
+		ms = int64(d)
+	default:
+		return nil, true, fmt.Errorf("invalid $date %v", val)
+	}
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond)), true, nil
+}
+
+// decodeBinary decodes base64 data, generic binary (subtype 0) is returned as a []byte,
+// the same way mgo does
+func decodeBinary(data, kind string) (interface{}, bool, error) {
+	ba, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid $binary (%s)", err.Error())
+	}
+	k, err := strconv.ParseUint(kind, 16, 8)
+	if err != nil {
+		return nil, true, fmt.Errorf("invalid $binary subType %s", kind)
+	}
+	if k == 0 {
+		return ba, true, nil
+	}
+	return bson.Binary{Kind: byte(k), Data: ba}, true, nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package extjson encodes and decodes documents as MongoDB extended json, so that bson types
+// (ObjectIds, dates, 64 bit integers, binary data etc.) survive the trip through json.
+//
+// Documents can be encoded in either the canonical or the relaxed form described in
+// https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+// the canonical form preserves every type, the relaxed form writes numbers and dates in a more
+// readable way, at the cost of no longer telling 32 and 64 bit integers apart.
+// Decoding understands both forms, as well as the legacy forms written by mongoexport and mejson.
+package extjson
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Mode is the form of extended json to encode
+type Mode int
+
+// extended json comes in two forms
+const (
+	// Canonical preserves all type information, at the expense of readability
+	Canonical Mode = iota
+
+	// Relaxed writes numbers as json numbers and dates as ISO-8601 strings
+	Relaxed
+)
+
+// Marshal encodes v as extended json
+func Marshal(v interface{}, mode Mode) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encode(&buf, v, mode); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a single extended json document
+func Unmarshal(data []byte) (bson.M, error) {
+	return NewDecoder(bytes.NewReader(data)).Decode()
+}
+
+// Encode converts v into plain json values (maps, slices, strings, float64s, bools and nil), with the bson types replaced by
+// their extended json representation.  It's useful when handing a document to something that only understands json, like a
+// javascript vm
+func Encode(v interface{}, mode Mode) (interface{}, error) {
+	ba, err := Marshal(v, mode)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(ba, &out)
+	return out, err
+}
+
+// Decode converts plain json values, as produced by Encode or encoding/json, back into bson types
+func Decode(v interface{}) (interface{}, error) {
+	return decodeValue(v)
+}
+
+// Decoder reads a stream of extended json documents
+type Decoder struct {
+	dec *json.Decoder
+}
+
+// NewDecoder returns a Decoder that reads from r
+func NewDecoder(r io.Reader) *Decoder {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	return &Decoder{dec: dec}
+}
+
+// Decode reads the next document from the stream.  io.EOF is returned at the end of the stream
+func (d *Decoder) Decode() (bson.M, error) {
+	var raw interface{}
+	if err := d.dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+	v, err := decodeValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("expected a document, got %T", v)
+	}
+	return doc, nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}, mode Mode) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+	case string:
+		writeString(buf, t)
+	case int:
+		if t >= math.MinInt32 && t <= math.MaxInt32 {
+			encodeInt(buf, "$numberInt", int64(t), mode)
+		} else {
+			encodeInt(buf, "$numberLong", int64(t), mode)
+		}
+	case int32:
+		encodeInt(buf, "$numberInt", int64(t), mode)
+	case int64:
+		encodeInt(buf, "$numberLong", t, mode)
+	case float32:
+		encodeFloat(buf, float64(t), mode)
+	case float64:
+		encodeFloat(buf, t, mode)
+	case time.Time:
+		ms := t.UnixNano() / int64(time.Millisecond)
+		if mode == Relaxed && t.Year() >= 1970 && t.Year() <= 9999 {
+			buf.WriteString(`{"$date":`)
+			writeString(buf, t.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+			buf.WriteString("}")
+		} else {
+			fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, ms)
+		}
+	case bson.ObjectId:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, t.Hex())
+	case []byte:
+		encodeBinary(buf, 0, t)
+	case bson.Binary:
+		encodeBinary(buf, t.Kind, t.Data)
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, uint32(t>>32), uint32(t))
+	case bson.RegEx:
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeString(buf, t.Pattern)
+		buf.WriteString(`,"options":`)
+		writeString(buf, t.Options)
+		buf.WriteString("}}")
+	case bson.Symbol:
+		buf.WriteString(`{"$symbol":`)
+		writeString(buf, string(t))
+		buf.WriteString("}")
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeString(buf, t.Code)
+		if t.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			if err := encode(buf, t.Scope, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case bson.DBPointer:
+		buf.WriteString(`{"$dbPointer":{"$ref":`)
+		writeString(buf, t.Namespace)
+		fmt.Fprintf(buf, `,"$id":{"$oid":"%s"}}}`, t.Id.Hex())
+	case bson.Decimal128:
+		fmt.Fprintf(buf, `{"$numberDecimal":"%s"}`, t.String())
+	case bson.M:
+		return encodeMap(buf, t, mode)
+	case map[string]interface{}:
+		return encodeMap(buf, t, mode)
+	case bson.D:
+		buf.WriteString("{")
+		for i, elem := range t {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			writeString(buf, elem.Name)
+			buf.WriteString(":")
+			if err := encode(buf, elem.Value, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case []interface{}:
+		buf.WriteString("[")
+		for i, elem := range t {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			if err := encode(buf, elem, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+	default:
+		switch v {
+		case bson.MinKey:
+			buf.WriteString(`{"$minKey":1}`)
+			return nil
+		case bson.MaxKey:
+			buf.WriteString(`{"$maxKey":1}`)
+			return nil
+		case bson.Undefined:
+			buf.WriteString(`{"$undefined":true}`)
+			return nil
+		}
+		return encodeReflect(buf, v, mode)
+	}
+	return nil
+}
+
+// encodeReflect handles the slices and maps of other types, ie. []string, as well as anything
+// else encoding/json knows about
+func encodeReflect(buf *bytes.Buffer, v interface{}, mode Mode) error {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		s := make([]interface{}, rv.Len())
+		for i := range s {
+			s[i] = rv.Index(i).Interface()
+		}
+		return encode(buf, s, mode)
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]interface{}, rv.Len())
+		for _, k := range rv.MapKeys() {
+			m[k.String()] = rv.MapIndex(k).Interface()
+		}
+		return encode(buf, m, mode)
+	case reflect.Int8, reflect.Int16:
+		return encode(buf, int32(rv.Int()), mode)
+	case reflect.Uint8, reflect.Uint16:
+		return encode(buf, int32(rv.Uint()), mode)
+	case reflect.Uint32, reflect.Uint, reflect.Uint64:
+		return encode(buf, int64(rv.Uint()), mode)
+	}
+
+	ba, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(ba)
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, m map[string]interface{}, mode Mode) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		writeString(buf, k)
+		buf.WriteString(":")
+		if err := encode(buf, m[k], mode); err != nil {
+			return err
+		}
+	}
+	buf.WriteString("}")
+	return nil
+}
+
+func encodeInt(buf *bytes.Buffer, key string, i int64, mode Mode) {
+	if mode == Relaxed {
+		buf.WriteString(strconv.FormatInt(i, 10))
+		return
+	}
+	fmt.Fprintf(buf, `{"%s":"%d"}`, key, i)
+}
+
+func encodeFloat(buf *bytes.Buffer, f float64, mode Mode) {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	case math.IsNaN(f):
+		s = "NaN"
+	default:
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		if f == math.Trunc(f) && !bytes.ContainsAny([]byte(s), "E.") {
+			s += ".0" // keep integral doubles from being read back as integers
+		}
+		if mode == Relaxed {
+			buf.WriteString(s)
+			return
+		}
+	}
+	fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, s)
+}
+
+func encodeBinary(buf *bytes.Buffer, kind byte, data []byte) {
+	fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(data), kind)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	ba, _ := json.Marshal(s)
+	buf.Write(ba)
+}
@@ -0,0 +1,100 @@
+package extjson
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	oid  = bson.ObjectIdHex("546656989330a846dc7ce327")
+	date = time.Unix(1416124056, 123*int64(time.Millisecond))
+)
+
+func TestMarshal(t *testing.T) {
+	data := []struct {
+		in        interface{}
+		canonical string
+		relaxed   string
+	}{
+		{bson.M{"_id": oid}, `{"_id":{"$oid":"546656989330a846dc7ce327"}}`, `{"_id":{"$oid":"546656989330a846dc7ce327"}}`},
+		{bson.M{"n": 1}, `{"n":{"$numberInt":"1"}}`, `{"n":1}`},
+		{bson.M{"n": int64(1)}, `{"n":{"$numberLong":"1"}}`, `{"n":1}`},
+		{bson.M{"n": 1.0}, `{"n":{"$numberDouble":"1.0"}}`, `{"n":1.0}`},
+		{bson.M{"n": 1.5}, `{"n":{"$numberDouble":"1.5"}}`, `{"n":1.5}`},
+		{bson.M{"d": date}, `{"d":{"$date":{"$numberLong":"1416124056123"}}}`, `{"d":{"$date":"2014-11-16T07:47:36.123Z"}}`},
+		{bson.M{"b": []byte("hi")}, `{"b":{"$binary":{"base64":"aGk=","subType":"00"}}}`, `{"b":{"$binary":{"base64":"aGk=","subType":"00"}}}`},
+		{bson.M{"a": []interface{}{"x", true, nil}}, `{"a":["x",true,null]}`, `{"a":["x",true,null]}`},
+		{bson.D{{Name: "z", Value: "last"}, {Name: "a", Value: "first"}}, `{"z":"last","a":"first"}`, `{"z":"last","a":"first"}`},
+	}
+
+	for _, v := range data {
+		canonical, err := Marshal(v.in, Canonical)
+		if err != nil || string(canonical) != v.canonical {
+			t.Errorf("canonical: expected %s, got %s (%v)", v.canonical, canonical, err)
+		}
+		relaxed, err := Marshal(v.in, Relaxed)
+		if err != nil || string(relaxed) != v.relaxed {
+			t.Errorf("relaxed: expected %s, got %s (%v)", v.relaxed, relaxed, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := bson.M{
+		"_id":       oid,
+		"int":       42,
+		"long":      int64(1) << 40,
+		"smalllong": int64(7),
+		"double":    2.0,
+		"date":      date,
+		"binary":    bson.Binary{Kind: 0x04, Data: []byte("uuid")},
+		"bytes":     []byte("bytes"),
+		"ts":        bson.MongoTimestamp(6442450945),
+		"regex":     bson.RegEx{Pattern: "^a", Options: "i"},
+		"nested":    bson.M{"list": []interface{}{oid, 1, "two"}},
+		"null":      nil,
+	}
+
+	ba, err := Marshal(in, Canonical)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	out, err := Unmarshal(ba)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// dates come back in the local timezone
+	out["date"] = out["date"].(time.Time).In(date.Location())
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("expected:\n%#v\ngot:\n%#v", in, out)
+	}
+}
+
+func TestUnmarshalLegacy(t *testing.T) {
+	data := []struct {
+		in  string
+		out bson.M
+	}{
+		{`{"d": {"$date": 1416124056123}}`, bson.M{"d": date}},
+		{`{"b": {"$binary": "aGk=", "$type": "80"}}`, bson.M{"b": bson.Binary{Kind: 0x80, Data: []byte("hi")}}},
+		{`{"r": {"$regex": "^a", "$options": "i"}}`, bson.M{"r": bson.RegEx{Pattern: "^a", Options: "i"}}},
+		{`{"n": 12345678901, "f": 1.0, "i": 3}`, bson.M{"n": int64(12345678901), "f": 1.0, "i": 3}},
+	}
+
+	for _, v := range data {
+		out, err := Unmarshal([]byte(v.in))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", v.in, err)
+			continue
+		}
+		if d, ok := out["d"].(time.Time); ok {
+			out["d"] = d.In(date.Location())
+		}
+		if !reflect.DeepEqual(out, v.out) {
+			t.Errorf("%s: expected %#v, got %#v", v.in, v.out, out)
+		}
+	}
+}
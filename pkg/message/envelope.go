@@ -0,0 +1,197 @@
+// Copyright 2014 The Transporter Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package message
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// An Envelope describes a change to a document for consumers outside of transporter, which need to know
+// what happened to the document and where, rather than just the document itself.
+// As a document, an envelope looks like
+//
+//	{"op": "update", "namespace": "db.table", "key": 1, "before": {...}, "after": {...}, "partial": false, "ts": 1500000000, "position": {...}}
+//
+// before is null for inserts, and after is null for deletes, so that a delete can be recognized without looking at the op.
+type Envelope struct {
+	Op        OpType
+	Namespace string
+	Key       interface{} // the document id
+	Before    bson.M      // the document before the change, or as much of it as the source knows
+	After     bson.M      // the document after the change.  for commands, this is the command
+	Partial   bool        // After only holds the fields that changed
+	Ts        int64       // when the source read the change, in seconds
+	Position  bson.M      // where the source read the change, ie. the position in the oplog, binlog or replication slot
+}
+
+// NewEnvelope describes the change carried by a message
+func NewEnvelope(msg *Msg) *Envelope {
+	e := &Envelope{
+		Op:        msg.Op,
+		Key:       msg.ID,
+		Partial:   msg.Partial,
+		Ts:        msg.Timestamp,
+		Namespace: msg.Namespace(),
+	}
+	for k, v := range msg.Meta {
+		if k == "namespace" {
+			continue
+		}
+		if e.Position == nil {
+			e.Position = bson.M{}
+		}
+		e.Position[k] = v
+	}
+
+	switch msg.Op {
+	case Insert, Command:
+		e.After = msg.Document()
+	case Update:
+		e.Before = msg.Before
+		e.After = msg.Document()
+	case Delete:
+		e.Before = msg.Before
+		if e.Before == nil {
+			e.Before = msg.Document()
+		}
+	}
+	return e
+}
+
+// Msg turns the envelope back into a message.  a delete without a before image is a delete of the key
+func (e *Envelope) Msg() *Msg {
+	var doc bson.M
+	switch e.Op {
+	case Delete:
+		doc = copyDoc(e.Before)
+		if doc == nil && e.Key != nil {
+			doc = bson.M{"_id": e.Key}
+		}
+	default:
+		doc = copyDoc(e.After)
+	}
+	if doc != nil && e.Key != nil && e.Op != Command {
+		if _, ok := doc["_id"]; !ok {
+			if _, ok := doc["id"]; !ok {
+				doc["_id"] = e.Key
+			}
+		}
+	}
+
+	msg := NewMsg(e.Op, doc)
+	msg.Partial = e.Partial
+	if e.Op == Update {
+		msg.Before = e.Before
+	}
+	if e.Ts != 0 {
+		msg.Timestamp = e.Ts
+	}
+	if e.Namespace != "" || len(e.Position) > 0 {
+		msg.Meta = bson.M{}
+		for k, v := range e.Position {
+			msg.Meta[k] = v
+		}
+		if e.Namespace != "" {
+			msg.Meta["namespace"] = e.Namespace
+		}
+	}
+	return msg
+}
+
+// Document returns the envelope as a document, ready to be encoded
+func (e *Envelope) Document() bson.M {
+	doc := bson.M{
+		"op":        e.Op.String(),
+		"namespace": e.Namespace,
+		"key":       e.Key,
+		"before":    nil,
+		"after":     nil,
+		"partial":   e.Partial,
+		"ts":        e.Ts,
+	}
+	if e.Before != nil {
+		doc["before"] = e.Before
+	}
+	if e.After != nil {
+		doc["after"] = e.After
+	}
+	if len(e.Position) > 0 {
+		doc["position"] = e.Position
+	}
+	return doc
+}
+
+// EnvelopeFromDocument reads an envelope from a document, as returned by Document
+func EnvelopeFromDocument(doc bson.M) (*Envelope, error) {
+	e := &Envelope{Key: doc["key"]}
+
+	op, ok := doc["op"].(string)
+	if !ok || op == "" {
+		return nil, fmt.Errorf("envelope has no op")
+	}
+	if e.Op = OpTypeFromString(op); e.Op == Unknown {
+		return nil, fmt.Errorf("envelope has an unknown op %q", op)
+	}
+
+	if e.Namespace, ok = doc["namespace"].(string); !ok && doc["namespace"] != nil {
+		return nil, fmt.Errorf("envelope namespace isn't a string")
+	}
+	if e.Partial, ok = doc["partial"].(bool); !ok && doc["partial"] != nil {
+		return nil, fmt.Errorf("envelope partial isn't a bool")
+	}
+	switch ts := doc["ts"].(type) {
+	case nil:
+	case int:
+		e.Ts = int64(ts)
+	case int32:
+		e.Ts = int64(ts)
+	case int64:
+		e.Ts = ts
+	case float64:
+		e.Ts = int64(ts)
+	default:
+		return nil, fmt.Errorf("envelope ts isn't a number")
+	}
+
+	for _, f := range []struct {
+		key string
+		doc *bson.M
+	}{{"before", &e.Before}, {"after", &e.After}, {"position", &e.Position}} {
+		switch v := doc[f.key].(type) {
+		case nil:
+		case bson.M:
+			*f.doc = v
+		case map[string]interface{}:
+			*f.doc = bson.M(v)
+		default:
+			return nil, fmt.Errorf("envelope %s isn't a document", f.key)
+		}
+	}
+
+	switch e.Op {
+	case Insert, Update, Command:
+		if e.After == nil {
+			return nil, fmt.Errorf("%s envelope has no after", op)
+		}
+	case Delete:
+		if e.Before == nil && e.Key == nil {
+			return nil, fmt.Errorf("delete envelope has no key or before")
+		}
+	}
+	return e, nil
+}
+
+func copyDoc(doc bson.M) bson.M {
+	if doc == nil {
+		return nil
+	}
+	c := make(bson.M, len(doc))
+	for k, v := range doc {
+		c[k] = v
+	}
+	return c
+}
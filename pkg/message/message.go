@@ -25,8 +25,12 @@ type Msg struct {
 	Op         OpType
 	ID         interface{}
 	OriginalID interface{}
-	document   bson.M // document is private
-	idKey      string // where the original id value is stored, either "_id" or "id"
+	Partial    bool     // an Update whose document only holds the fields that changed, rather than the whole document
+	Meta       bson.M   // anything else the source knows about the message, ie. the position of the operation in the oplog
+	Receipt    *Receipt // if set, the source is waiting to hear that the message has been delivered
+	Before     bson.M   // for Updates, the document before it was updated, if the source knows it
+	document   bson.M   // document is private
+	idKey      string   // where the original id value is stored, either "_id" or "id"
 }
 
 // NewMsg returns a new Msg with the ID extracted
@@ -44,6 +48,38 @@ func NewMsg(op OpType, doc bson.M) *Msg {
 	return m
 }
 
+// NewCommandMsg returns a new Command Msg for the given CommandType.
+// the command is stored in the document as {"<command>": arg}, a nil arg is stored as true
+func NewCommandMsg(c CommandType, arg interface{}) *Msg {
+	if arg == nil {
+		arg = true
+	}
+	return NewMsg(Command, bson.M{c.String(): arg})
+}
+
+// Command returns the type of command carried by a Command Msg, along with the command's argument.
+// ok is false if this isn't a Command Msg, or if the command isn't one we know about
+func (m *Msg) Command() (c CommandType, arg interface{}, ok bool) {
+	if m.Op != Command {
+		return
+	}
+	for _, c = range commandTypes {
+		if arg, ok = m.document[c.String()]; ok {
+			return
+		}
+	}
+	return
+}
+
+// IsCommand reports whether this is a Command Msg for the given CommandType
+func (m *Msg) IsCommand(c CommandType) bool {
+	if m.Op != Command {
+		return false
+	}
+	_, ok := m.document[c.String()]
+	return ok
+}
+
 // extractID will handle separating the id field from the
 // rest of the document, can handle both 'id' and '_id'
 func (m *Msg) extractID(doc bson.M) (bson.M, interface{}) {
@@ -56,10 +92,18 @@ func (m *Msg) extractID(doc bson.M) (bson.M, interface{}) {
 		}
 	}
 
-	fmt.Printf("id not found %+v\n", doc)
+	if m.Op != Command { // commands don't carry a document id
+		fmt.Printf("id not found %+v\n", doc)
+	}
 	return doc, nil
 }
 
+// Namespace returns the namespace the source read the message from, if the source told us
+func (m *Msg) Namespace() string {
+	ns, _ := m.Meta["namespace"].(string)
+	return ns
+}
+
 // IDString returns the original id as a string value
 func (m *Msg) IDString() string {
 	switch t := m.ID.(type) {
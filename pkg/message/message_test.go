@@ -188,3 +188,156 @@ func TestOriginalIdOnSet(t *testing.T) {
 		}
 	}
 }
+
+func TestNewCommandMsg(t *testing.T) {
+	data := []struct {
+		in   CommandType
+		isnt CommandType
+		out  bson.M
+	}{
+		{Flush, CopyComplete, bson.M{"flush": true}},
+		{CopyComplete, Flush, bson.M{"copy_complete": true}},
+	}
+
+	for _, v := range data {
+		msg := NewCommandMsg(v.in, nil)
+		if msg.Op != Command {
+			t.Errorf("%s: expected a command, got %s", v.in, msg.Op)
+		}
+		if !msg.IsCommand(v.in) {
+			t.Errorf("%s: expected IsCommand(%s) to be true", v.in, v.in)
+		}
+		if msg.IsCommand(v.isnt) {
+			t.Errorf("%s: expected IsCommand(%s) to be false", v.in, v.isnt)
+		}
+		if !reflect.DeepEqual(msg.Document(), v.out) {
+			t.Errorf("%s: expected %v, got %v", v.in, v.out, msg.Document())
+		}
+	}
+
+	if NewMsg(Insert, bson.M{"flush": true}).IsCommand(Flush) {
+		t.Errorf("expected an insert to not be a command")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	data := []struct {
+		in  *Msg
+		c   CommandType
+		arg interface{}
+		ok  bool
+	}{
+		{NewCommandMsg(Drop, nil), Drop, true, true},
+		{NewCommandMsg(Rename, "db.newcoll"), Rename, "db.newcoll", true},
+		{NewMsg(Command, bson.M{"nope": true}), 0, nil, false},
+		{NewMsg(Insert, bson.M{"drop": true}), 0, nil, false},
+	}
+
+	for _, v := range data {
+		c, arg, ok := v.in.Command()
+		if ok != v.ok {
+			t.Errorf("%v: expected ok to be %t", v.in.Document(), v.ok)
+			continue
+		}
+		if ok && (c != v.c || arg != v.arg) {
+			t.Errorf("%v: expected %s %v, got %s %v", v.in.Document(), v.c, v.arg, c, arg)
+		}
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	r := NewReceipt()
+	r.Add(2) // sent down three branches
+	for i := 0; i < 3; i++ {
+		select {
+		case <-r.Done():
+			t.Fatalf("expected the receipt to wait for %d more sinks", 3-i)
+		default:
+		}
+		r.Processed()
+	}
+	select {
+	case <-r.Done():
+	default:
+		t.Errorf("expected the receipt to be done")
+	}
+
+	// nowhere to send the message
+	r = NewReceipt()
+	r.Add(-1)
+	select {
+	case <-r.Done():
+	default:
+		t.Errorf("expected the receipt to be done")
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	update := NewMsg(Update, bson.M{"id": 1, "name": "after"})
+	update.Before = bson.M{"id": 1, "name": "before"}
+	update.Meta = bson.M{"namespace": "db.table", "lsn": "0/16B3748"}
+	partial := NewMsg(Update, bson.M{"_id": "a", "name": "after"})
+	partial.Partial = true
+
+	data := []struct {
+		in       *Msg
+		before   bson.M
+		after    bson.M
+		position bson.M
+	}{
+		{NewMsg(Insert, bson.M{"_id": "a", "name": "after"}), nil, bson.M{"_id": "a", "name": "after"}, nil},
+		{update, bson.M{"id": 1, "name": "before"}, bson.M{"id": 1, "name": "after"}, bson.M{"lsn": "0/16B3748"}},
+		{partial, nil, bson.M{"_id": "a", "name": "after"}, nil},
+		{NewMsg(Delete, bson.M{"_id": "a"}), bson.M{"_id": "a"}, nil, nil},
+		{NewCommandMsg(Drop, nil), nil, bson.M{"drop": true}, nil},
+	}
+
+	for _, v := range data {
+		e := NewEnvelope(v.in)
+		if e.Op != v.in.Op || e.Partial != v.in.Partial || e.Ts != v.in.Timestamp {
+			t.Errorf("%s: expected op, partial and ts to be copied, got %+v", v.in.Op, e)
+		}
+		if !reflect.DeepEqual(e.Before, v.before) || !reflect.DeepEqual(e.After, v.after) || !reflect.DeepEqual(e.Position, v.position) {
+			t.Errorf("%s: expected before %v, after %v, position %v, got %v, %v, %v", v.in.Op, v.before, v.after, v.position, e.Before, e.After, e.Position)
+		}
+
+		back, err := EnvelopeFromDocument(e.Document())
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", v.in.Op, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(back, e) {
+			t.Errorf("%s: expected %+v, got %+v", v.in.Op, e, back)
+		}
+
+		msg := back.Msg()
+		if msg.Op != v.in.Op || msg.ID != v.in.ID || msg.Partial != v.in.Partial || msg.Namespace() != v.in.Namespace() {
+			t.Errorf("%s: expected %+v, got %+v", v.in.Op, v.in, msg)
+		}
+		if !reflect.DeepEqual(msg.Document(), v.in.Document()) {
+			t.Errorf("%s: expected document %v, got %v", v.in.Op, v.in.Document(), msg.Document())
+		}
+	}
+
+	// a delete can be described by it's key alone
+	e, err := EnvelopeFromDocument(bson.M{"op": "delete", "key": "a", "before": nil, "after": nil})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+	if msg := e.Msg(); msg.Op != Delete || msg.ID != "a" {
+		t.Errorf("expected a delete of a, got %s %v", msg.Op, msg.ID)
+	}
+
+	for _, doc := range []bson.M{
+		{"after": bson.M{"_id": "a"}},
+		{"op": "nope", "after": bson.M{"_id": "a"}},
+		{"op": "insert", "after": nil},
+		{"op": "insert", "after": "a"},
+		{"op": "delete"},
+		{"op": "insert", "after": bson.M{"_id": "a"}, "ts": "yesterday"},
+	} {
+		if _, err := EnvelopeFromDocument(doc); err == nil {
+			t.Errorf("%v: expected an error", doc)
+		}
+	}
+}
@@ -61,4 +61,41 @@ const (
 	// Flush is interpreted by the recieving sink adaptors to attempt to flush all buffered
 	// operations to the database.  This can be useful when switching from a copy to a tail operation
 	Flush CommandType = iota
+
+	// CopyComplete is sent by source adaptors once the initial copy of the data has finished.
+	// Every message before it is part of the copy, and every message after it is a tailed operation.
+	// Sinks should treat it as a Flush
+	CopyComplete
+
+	// Drop is sent when the source collection / table has been dropped
+	Drop
+
+	// Create is sent when the source collection / table has been created
+	Create
+
+	// Rename is sent when the source collection / table has been renamed.
+	// the argument is the new namespace
+	Rename
 )
+
+// commandTypes lists the commands that can be carried by a Command message
+var commandTypes = []CommandType{Flush, CopyComplete, Drop, Create, Rename}
+
+// String returns the name of the command, which is also the key used to
+// identify the command in a Command message's document
+func (c CommandType) String() string {
+	switch c {
+	case Flush:
+		return "flush"
+	case CopyComplete:
+		return "copy_complete"
+	case Drop:
+		return "drop"
+	case Create:
+		return "create"
+	case Rename:
+		return "rename"
+	default:
+		return "unknown"
+	}
+}
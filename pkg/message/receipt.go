@@ -0,0 +1,48 @@
+package message
+
+import (
+	"sync/atomic"
+)
+
+// A Receipt follows a message through the pipeline, so that a source can tell when the message has been delivered.
+// the receipt is done once every sink has processed the message.  sinks process messages in order, so when a
+// Flush command's receipt is done, everything the source sent before the flush has been written too
+type Receipt struct {
+	pending int32
+	done    chan struct{}
+}
+
+// NewReceipt creates a receipt for a message that's about to be sent
+func NewReceipt() *Receipt {
+	return &Receipt{pending: 1, done: make(chan struct{})}
+}
+
+// Add records that the message has been sent down n more branches of the pipeline.  n is -1 when there was
+// nowhere to send the message, in which case there's nothing to wait for
+func (r *Receipt) Add(n int) {
+	if atomic.AddInt32(&r.pending, int32(n)) == 0 {
+		close(r.done)
+	}
+}
+
+// Processed is called by each sink once it's dealt with the message
+func (r *Receipt) Processed() {
+	if atomic.AddInt32(&r.pending, -1) == 0 {
+		close(r.done)
+	}
+}
+
+// Done returns a channel that's closed once every sink has processed the message
+func (r *Receipt) Done() <-chan struct{} {
+	return r.done
+}
+
+// Delivered reports whether every sink has processed the message
+func (r *Receipt) Delivered() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
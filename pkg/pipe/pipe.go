@@ -94,6 +94,11 @@ func (m *Pipe) Listen(fn func(*message.Msg) (*message.Msg, error)) error {
 				m.Send(outmsg)
 			} else {
 				m.MessageCount++ // update the count anyway
+
+				// we're a sink, let the source know that we're done with the message
+				if outmsg.Receipt != nil {
+					outmsg.Receipt.Processed()
+				}
 			}
 		case <-time.After(100 * time.Millisecond):
 			// NOP, just breath
@@ -118,6 +123,9 @@ func (m *Pipe) Stop() {
 // Send emits the given message on the 'Out' channel.  the send Timesout after 100 ms in order to chaeck of the Pipe has stopped and we've been asked to exit.
 // If the Pipe has been stopped, the send will fail and there is no guarantee of either success or failure
 func (m *Pipe) Send(msg *message.Msg) {
+	if msg.Receipt != nil { // each branch of the pipeline has to process the message
+		msg.Receipt.Add(len(m.Out) - 1)
+	}
 	for _, ch := range m.Out {
 
 	A:
@@ -3,18 +3,21 @@
 package transporter
 
 import (
+	"database/sql"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/compose/transporter/pkg/adaptor"
+	_ "github.com/lib/pq"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	mongoUri = "mongodb://localhost/test"
+	mongoUri    = "mongodb://localhost/test"
+	postgresUri = "postgres://localhost/test?sslmode=disable"
 )
 
 // set up some local files
@@ -159,3 +162,56 @@ func TestMongoToMongo(t *testing.T) {
 	mongoSess.DB("test").C("inColl").DropCollection()
 
 }
+
+//
+//
+//
+
+func TestMongoToPostgres(t *testing.T) {
+	setupMongo()
+
+	db, err := sql.Open("postgres", postgresUri)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	db.Exec("DROP TABLE IF EXISTS public.in_coll")
+
+	// create the source node and attach our sink
+	outNode := NewNode("localOutmongo", "mongo", adaptor.Config{"uri": mongoUri, "namespace": "test.outColl"}).
+		Add(NewNode("localInpostgres", "postgres", adaptor.Config{"uri": postgresUri, "namespace": "public.in_coll", "create": true}))
+
+	// create the pipeline
+	p, err := NewDefaultPipeline(outNode, "", "", "", 100*time.Millisecond)
+	if err != nil {
+		t.Errorf("can't create pipeline, got %s", err.Error())
+		t.FailNow()
+	}
+
+	// run it
+	err = p.Run()
+	if err != nil {
+		t.Errorf("error running pipeline, got %s", err.Error())
+		t.FailNow()
+	}
+
+	// are the counts the same?
+	mongoSess, err := mgo.Dial(mongoUri)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer mongoSess.Close()
+	outCount, _ := mongoSess.DB("test").C("outColl").Count()
+
+	var inCount int
+	if err = db.QueryRow("SELECT count(*) FROM public.in_coll").Scan(&inCount); err != nil {
+		t.Fatal(err.Error())
+	}
+	if outCount != inCount {
+		t.Errorf("Incorrect table size\nexp %d\ngot %d\n", outCount, inCount)
+	}
+
+	// clean up
+	mongoSess.DB("test").C("outColl").DropCollection()
+	db.Exec("DROP TABLE public.in_coll")
+}